@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Command dnstest starts DNS servers for testing non-Go DNS clients.
+//
+// Usage:
+//
+//	dnstest [flags]
+//
+// The servers use the records, zones, and servers described by the YAML or
+// JSON document passed using -config (see [dnstest.ParseDocument]), the hosts
+// file passed using -hosts, and the -record, -udp, -tcp, -tls, and -https flags.
+// Without servers, we start all of them using 127.0.0.1 and random ports.
+//
+// The TLS and HTTPS servers use a self-signed certificate generated using
+// pkitest and stored inside the -cert-dir directory, which we also copy to
+// the ca.pem file, such that clients can trust it (e.g., curl --cacert).
+//
+// We print the server addresses and the ca.pem path to the standard output
+// and run until we receive SIGINT or SIGTERM. For example:
+//
+//	dnstest -record www.example.com=104.20.34.220 -udp 127.0.0.1:5353
+//	dig @127.0.0.1 -p 5353 www.example.com
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/pkitest"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// run parses the command line, starts the servers, prints their addresses,
+// and waits for the context to be done before closing the servers.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) (err error) {
+	// 1. convert the panics of the Must* functions into errors
+	defer func() {
+		switch r := recover().(type) {
+		case nil:
+			// nothing
+		case error:
+			err = r
+		default:
+			err = fmt.Errorf("dnstest: %v", r)
+		}
+	}()
+
+	// 2. parse the command line
+	doc := &dnstest.Document{}
+	fset := flag.NewFlagSet("dnstest", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	certDir := fset.String("cert-dir", filepath.Join(os.TempDir(), "dnstest"), "directory containing the certificates")
+	certNames := fset.String("cert-names", "dns.example.com", "comma-separated DNS names of the certificate")
+	configPath := fset.String("config", "", "YAML or JSON document to load")
+	hostsPath := fset.String("hosts", "", "hosts file to load")
+	hostsCNAME := fset.Bool("hosts-cname", false, "map the hosts file aliases to CNAME records")
+	fset.Func("record", "add NAME=ADDRESS or NAME=TARGET for CNAME records (repeatable)", func(value string) error {
+		record, err := parseRecordFlag(value)
+		doc.Records = append(doc.Records, record)
+		return err
+	})
+	for _, protocol := range []string{"udp", "tcp", "tls", "https"} {
+		fset.Func(protocol, "start a "+strings.ToUpper(protocol)+" server listening on ADDRESS (repeatable)", func(value string) error {
+			doc.Servers = append(doc.Servers, dnstest.DocumentServer{Protocol: protocol, Address: value})
+			return nil
+		})
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+	if fset.NArg() > 0 {
+		return fmt.Errorf("dnstest: unexpected arguments: %s", strings.Join(fset.Args(), " "))
+	}
+
+	// 3. merge the document passed using -config with the flags
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return err
+		}
+		fileDoc, err := dnstest.ParseDocument(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *configPath, err)
+		}
+		fileDoc.Records = append(fileDoc.Records, doc.Records...)
+		fileDoc.Servers = append(fileDoc.Servers, doc.Servers...)
+		doc = fileDoc
+	}
+	if len(doc.Servers) <= 0 {
+		for _, protocol := range []string{"udp", "tcp", "tls", "https"} {
+			doc.Servers = append(doc.Servers, dnstest.DocumentServer{Protocol: protocol})
+		}
+	}
+
+	// 4. create the handler config
+	config := doc.MustNewHandlerConfig()
+	if *hostsPath != "" {
+		if err := addHostsFile(config, *hostsPath, *hostsCNAME); err != nil {
+			return err
+		}
+	}
+
+	// 5. create the certificate and the ca.pem file
+	cert, caPath, err := newCert(*certDir, strings.Split(*certNames, ","), doc.Servers)
+	if err != nil {
+		return err
+	}
+
+	// 6. start the servers and print their addresses
+	servers := doc.MustNewServers(&net.ListenConfig{}, cert, dnstest.NewHandler(config))
+	defer servers.Close()
+	for _, srv := range servers.UDP {
+		fmt.Fprintf(stdout, "udp\t%s\n", srv.Address())
+	}
+	for _, srv := range servers.TCP {
+		fmt.Fprintf(stdout, "tcp\t%s\n", srv.Address())
+	}
+	for _, srv := range servers.TLS {
+		fmt.Fprintf(stdout, "tls\t%s\n", srv.Address())
+	}
+	for _, srv := range servers.HTTPS {
+		fmt.Fprintf(stdout, "https\t%s\n", srv.URL())
+	}
+	fmt.Fprintf(stdout, "ca\t%s\n", caPath)
+
+	// 7. run until signaled
+	<-ctx.Done()
+	return nil
+}
+
+// parseRecordFlag parses the value of the -record flag.
+func parseRecordFlag(value string) (dnstest.DocumentRecord, error) {
+	name, target, found := strings.Cut(value, "=")
+	if !found {
+		return dnstest.DocumentRecord{}, errors.New("expected NAME=ADDRESS or NAME=TARGET")
+	}
+	record := dnstest.DocumentRecord{Name: name, Type: "CNAME", Value: target}
+	if addr, err := netip.ParseAddr(target); err == nil {
+		record.Type = "A"
+		if addr.Is6() {
+			record.Type = "AAAA"
+		}
+	}
+	return record, nil
+}
+
+// addHostsFile adds the content of the given hosts file to the config.
+func addHostsFile(config *dnstest.HandlerConfig, path string, cname bool) error {
+	filep, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer filep.Close()
+	mode := dnstest.HostsAliasAddrs
+	if cname {
+		mode = dnstest.HostsAliasCNAME
+	}
+	if err := config.AddHosts(filep, mode); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// newCert returns a certificate valid for the given names and for the IP
+// addresses of the servers, along with the path of the ca.pem file.
+func newCert(certDir string, names []string, servers []dnstest.DocumentServer) (tls.Certificate, string, error) {
+	// 1. collect the IP addresses
+	ipAddrs := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	for _, server := range servers {
+		host, _, err := net.SplitHostPort(server.Address)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			ipAddrs = append(ipAddrs, ip)
+		}
+	}
+
+	// 2. generate or reuse the certificate
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return tls.Certificate{}, "", err
+	}
+	cert := pkitest.MustNewPKI(certDir).MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   names[0],
+		DNSNames:     names,
+		IPAddrs:      ipAddrs,
+		Organization: []string{"dnstest"},
+	})
+
+	// 3. write the ca.pem file
+	caPath := filepath.Join(certDir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+		return tls.Certificate{}, "", err
+	}
+	return cert, caPath, nil
+}
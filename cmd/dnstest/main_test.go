@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startRunTest starts run in the background and returns the printed
+// addresses by protocol along with the function to stop it.
+func startRunTest(t *testing.T, args ...string) (map[string]string, func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	errch := make(chan error, 1)
+	go func() {
+		err := run(ctx, args, writer, io.Discard)
+		writer.CloseWithError(err)
+		errch <- err
+	}()
+
+	// read the addresses until we see the ca.pem path
+	addrs := map[string]string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		protocol, address, _ := strings.Cut(scanner.Text(), "\t")
+		addrs[protocol] = address
+		if protocol == "ca" {
+			break
+		}
+	}
+	go io.Copy(io.Discard, reader)
+
+	stop := func() error {
+		cancel()
+		return <-errch
+	}
+	return addrs, stop
+}
+
+func TestRun(t *testing.T) {
+	// write a config file and a hosts file
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	config := "records:\n  - name: www.example.com\n    type: A\n    value: 104.20.34.220\n"
+	assert.NoError(t, os.WriteFile(configPath, []byte(config), 0600))
+	hostsPath := filepath.Join(dir, "hosts")
+	assert.NoError(t, os.WriteFile(hostsPath, []byte("192.0.2.1 host.example.com alias.example.com\n"), 0600))
+
+	// start all the servers
+	addrs, stop := startRunTest(t,
+		"-cert-dir", filepath.Join(dir, "certs"),
+		"-config", configPath,
+		"-hosts", hostsPath,
+		"-hosts-cname",
+		"-record", "v6.example.com=2001:db8::1",
+		"-record", "www.example.org=www.example.com",
+	)
+	assert.Len(t, addrs, 5)
+
+	// exchange is the function to query the plaintext and TLS servers.
+	exchange := func(network, address, name string, qtype uint16) []dns.RR {
+		client := &dns.Client{Net: network, Timeout: 10 * time.Second}
+		if network == "tcp-tls" {
+			pool := x509.NewCertPool()
+			caPEM, err := os.ReadFile(addrs["ca"])
+			assert.NoError(t, err)
+			assert.True(t, pool.AppendCertsFromPEM(caPEM))
+			client.TLSConfig = &tls.Config{RootCAs: pool, ServerName: "dns.example.com"}
+		}
+		query := &dns.Msg{}
+		query.SetQuestion(dns.CanonicalName(name), qtype)
+		resp, _, err := client.Exchange(query, address)
+		assert.NoError(t, err)
+		if resp == nil {
+			return nil
+		}
+		return resp.Answer
+	}
+
+	// make sure the records from all the sources work
+	assert.Len(t, exchange("udp", addrs["udp"], "www.example.com", dns.TypeA), 1)
+	assert.Len(t, exchange("tcp", addrs["tcp"], "v6.example.com", dns.TypeAAAA), 1)
+	assert.Len(t, exchange("tcp-tls", addrs["tls"], "www.example.org", dns.TypeA), 2)
+	assert.Len(t, exchange("udp", addrs["udp"], "alias.example.com", dns.TypeA), 2)
+
+	// make sure the HTTPS server works using the ca.pem file
+	t.Run("https", func(t *testing.T) {
+		caPEM, err := os.ReadFile(addrs["ca"])
+		assert.NoError(t, err)
+		pool := x509.NewCertPool()
+		assert.True(t, pool.AppendCertsFromPEM(caPEM))
+		query := &dns.Msg{}
+		query.SetQuestion("www.example.com.", dns.TypeA)
+		rawQuery, err := query.Pack()
+		assert.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		httpResp, err := client.Post(addrs["https"], "application/dns-message", strings.NewReader(string(rawQuery)))
+		assert.NoError(t, err)
+		defer httpResp.Body.Close()
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	})
+
+	assert.NoError(t, stop())
+}
+
+func TestRunSelectedServers(t *testing.T) {
+	addrs, stop := startRunTest(t, "-cert-dir", t.TempDir(), "-udp", "127.0.0.1:0", "-udp", "127.0.0.1:0")
+	assert.NoError(t, stop())
+	assert.Contains(t, addrs, "udp")
+	assert.NotContains(t, addrs, "tcp")
+	assert.Contains(t, addrs, "ca")
+}
+
+func TestRunErrors(t *testing.T) {
+	type testCase struct {
+		name      string
+		args      []string
+		expectErr string
+	}
+
+	testCases := []testCase{
+		{
+			name:      "unknown flag",
+			args:      []string{"-nonexistent"},
+			expectErr: "flag provided but not defined: -nonexistent",
+		},
+
+		{
+			name:      "invalid record",
+			args:      []string{"-record", "www.example.com"},
+			expectErr: `invalid value "www.example.com" for flag -record: expected NAME=ADDRESS or NAME=TARGET`,
+		},
+
+		{
+			name:      "unexpected arguments",
+			args:      []string{"extra"},
+			expectErr: "dnstest: unexpected arguments: extra",
+		},
+
+		{
+			name:      "missing config file",
+			args:      []string{"-config", "/nonexistent/config.yaml"},
+			expectErr: "open /nonexistent/config.yaml: no such file or directory",
+		},
+
+		{
+			name:      "invalid server address",
+			args:      []string{"-udp", "127.0.0.1"},
+			expectErr: `dnstest: document: servers[0].address: invalid address "127.0.0.1"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := run(context.Background(), tc.args, io.Discard, io.Discard)
+			assert.EqualError(t, err, tc.expectErr)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CookieMode configures DNS Cookies (see RFC 7873) for [*HandlerConfig.SetCookieMode].
+type CookieMode int
+
+const (
+	// CookieModeDisabled ignores the COOKIE option.
+	CookieModeDisabled = CookieMode(iota)
+
+	// CookieModeEnabled generates and validates server cookies but
+	// answers the queries lacking a valid server cookie anyway.
+	CookieModeEnabled
+
+	// CookieModeEnforced is like [CookieModeEnabled] but responds with
+	// BADCOOKIE to the queries including a COOKIE option that lacks a
+	// valid server cookie. The queries without a COOKIE option are
+	// answered normally, as required by RFC 7873.
+	CookieModeEnforced
+)
+
+// CookieState contains the DNS Cookies state of a [*HandlerConfig].
+type CookieState struct {
+	// BadCookie counts the BADCOOKIE responses.
+	BadCookie int
+
+	// ClientOnly counts the queries including only the client cookie.
+	ClientOnly int
+
+	// FormErr counts the queries including a malformed COOKIE option.
+	FormErr int
+
+	// Invalid counts the queries including an invalid server cookie.
+	Invalid int
+
+	// LastClientCookie is the hex-encoded last client cookie we have seen.
+	LastClientCookie string
+
+	// LastServerCookie is the hex-encoded last server cookie we have sent.
+	LastServerCookie string
+
+	// Missing counts the queries without a COOKIE option.
+	Missing int
+
+	// Valid counts the queries including a valid server cookie.
+	Valid int
+}
+
+// cookieConfig is the DNS Cookies configuration of a [*HandlerConfig].
+type cookieConfig struct {
+	// mode is the cookie mode.
+	mode CookieMode
+
+	// secret is the secret used to compute the server cookies.
+	secret [16]byte
+
+	// state is the cookie state.
+	state CookieState
+}
+
+// Server cookies use the RFC 9018 layout (version, reserved, timestamp, and
+// hash) with the following constants. Note that we use a truncated HMAC-SHA256
+// rather than SipHash-2-4 because the server cookie is opaque to clients.
+const (
+	cookieClientSize    = 8
+	cookieServerMinSize = 8
+	cookieServerMaxSize = 32
+	cookieServerSize    = 16
+	cookieVersion       = 1
+	cookieMaxAge        = time.Hour
+	cookieMaxSkew       = 5 * time.Minute
+)
+
+// SetCookieMode sets the [CookieMode] and generates a new cookie secret, which
+// invalidates the server cookies previously sent to the clients.
+//
+// This method is safe to call while the handler is running.
+func (c *HandlerConfig) SetCookieMode(mode CookieMode) {
+	c.mu.Lock()
+	c.cookies.mode = mode
+	rand.Read(c.cookies.secret[:])
+	c.mu.Unlock()
+}
+
+// CookieState returns a copy of the [CookieState].
+func (c *HandlerConfig) CookieState() CookieState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cookies.state
+}
+
+// checkCookie checks the COOKIE option of the query and returns the COOKIE
+// option to include into the response, if any, and the rcode to use,
+// where [dns.RcodeSuccess] means that we should answer the query.
+func (c *HandlerConfig) checkCookie(rw dns.ResponseWriter, query *dns.Msg) (*dns.EDNS0_COOKIE, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 1. check whether cookies are enabled
+	if c.cookies.mode == CookieModeDisabled {
+		return nil, dns.RcodeSuccess
+	}
+
+	// 2. find the COOKIE option
+	var option *dns.EDNS0_COOKIE
+	if opt := query.IsEdns0(); opt != nil {
+		for _, entry := range opt.Option {
+			if cookie, ok := entry.(*dns.EDNS0_COOKIE); ok {
+				option = cookie
+			}
+		}
+	}
+	if option == nil {
+		c.cookies.state.Missing++
+		return nil, dns.RcodeSuccess
+	}
+
+	// 3. make sure the COOKIE option is well formed
+	raw, err := hex.DecodeString(option.Cookie)
+	if err != nil || len(raw) < cookieClientSize || (len(raw) > cookieClientSize &&
+		(len(raw) < cookieClientSize+cookieServerMinSize || len(raw) > cookieClientSize+cookieServerMaxSize)) {
+		c.cookies.state.FormErr++
+		return nil, dns.RcodeFormatError
+	}
+	clientCookie, serverCookie := raw[:cookieClientSize], raw[cookieClientSize:]
+	c.cookies.state.LastClientCookie = hex.EncodeToString(clientCookie)
+
+	// 4. validate the server cookie, if any
+	clientIP := cookieClientIP(rw)
+	now := time.Now()
+	valid := false
+	switch {
+	case len(serverCookie) <= 0:
+		c.cookies.state.ClientOnly++
+	case c.validServerCookieLocked(clientCookie, serverCookie, clientIP, now):
+		c.cookies.state.Valid++
+		valid = true
+	default:
+		c.cookies.state.Invalid++
+	}
+
+	// 5. generate a fresh server cookie and decide the rcode
+	fresh := c.newServerCookieLocked(clientCookie, clientIP, now)
+	c.cookies.state.LastServerCookie = hex.EncodeToString(fresh)
+	response := &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(slices.Concat(clientCookie, fresh)),
+	}
+	if !valid && c.cookies.mode == CookieModeEnforced {
+		c.cookies.state.BadCookie++
+		return response, dns.RcodeBadCookie
+	}
+	return response, dns.RcodeSuccess
+}
+
+// newServerCookieLocked returns a new server cookie using the given timestamp.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) newServerCookieLocked(clientCookie []byte, clientIP []byte, now time.Time) []byte {
+	cookie := make([]byte, 8, cookieServerSize)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], uint32(now.Unix()))
+	mac := hmac.New(sha256.New, c.cookies.secret[:])
+	mac.Write(clientCookie)
+	mac.Write(cookie)
+	mac.Write(clientIP)
+	return mac.Sum(cookie)[:cookieServerSize]
+}
+
+// validServerCookieLocked returns whether the server cookie is valid.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) validServerCookieLocked(
+	clientCookie, serverCookie []byte, clientIP []byte, now time.Time) bool {
+	if len(serverCookie) != cookieServerSize || serverCookie[0] != cookieVersion {
+		return false
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(serverCookie[4:8])), 0)
+	if timestamp.Before(now.Add(-cookieMaxAge)) || timestamp.After(now.Add(cookieMaxSkew)) {
+		return false
+	}
+	expect := c.newServerCookieLocked(clientCookie, clientIP, timestamp)
+	return hmac.Equal(expect, serverCookie)
+}
+
+// cookieClientIP returns the client IP address used to compute the server
+// cookie, which is empty when the rw is nil or the address is unknown.
+func cookieClientIP(rw dns.ResponseWriter) []byte {
+	if rw == nil {
+		return nil
+	}
+	addrport, found := addrPortFromNetAddr(rw.RemoteAddr())
+	if !found {
+		return nil
+	}
+	return addrport.Addr().AsSlice()
+}
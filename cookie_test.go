@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// cookieTestClientCookie is the client cookie used by the tests.
+const cookieTestClientCookie = "0102030405060708"
+
+// newCookieTestQuery creates a query for www.example.com with the given hex-encoded cookie.
+func newCookieTestQuery(cookie string) *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	query.SetEdns0(handlerEDNS0Size, false)
+	if cookie != "" {
+		opt := query.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return query
+}
+
+// collectCookie returns the hex-encoded cookie within the OPT record, if any.
+func collectCookie(resp *dns.Msg) string {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+				return cookie.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+// newCookieTestServer creates a UDP server using the given cookie mode.
+func newCookieTestServer(mode CookieMode) (*HandlerConfig, *UDPServer) {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	config.SetCookieMode(mode)
+	return config, MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config))
+}
+
+func TestHandlerCookieModeEnabled(t *testing.T) {
+	config, srv := newCookieTestServer(CookieModeEnabled)
+	defer srv.Close()
+
+	// the first query only contains the client cookie
+	resp, err := dns.Exchange(newCookieTestQuery(cookieTestClientCookie), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	cookie := collectCookie(resp)
+	assert.Len(t, cookie, 2*(cookieClientSize+cookieServerSize))
+	assert.Equal(t, cookieTestClientCookie, cookie[:2*cookieClientSize])
+
+	// the second query contains the server cookie
+	resp, err = dns.Exchange(newCookieTestQuery(cookie), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	// an invalid server cookie is tolerated
+	resp, err = dns.Exchange(newCookieTestQuery(cookieTestClientCookie+"0000000000000000"), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	state := config.CookieState()
+	assert.Equal(t, 1, state.ClientOnly)
+	assert.Equal(t, 1, state.Valid)
+	assert.Equal(t, 1, state.Invalid)
+	assert.Equal(t, 0, state.BadCookie)
+	assert.Equal(t, cookieTestClientCookie, state.LastClientCookie)
+	assert.Equal(t, collectCookie(resp)[2*cookieClientSize:], state.LastServerCookie)
+}
+
+func TestHandlerCookieModeEnforced(t *testing.T) {
+	config, srv := newCookieTestServer(CookieModeEnforced)
+	defer srv.Close()
+
+	// the first query gets BADCOOKIE along with the server cookie
+	resp, err := dns.Exchange(newCookieTestQuery(cookieTestClientCookie), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeBadCookie, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	cookie := collectCookie(resp)
+
+	// the retry with the server cookie succeeds
+	resp, err = dns.Exchange(newCookieTestQuery(cookie), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+
+	// a cookie computed for another client address is invalid
+	other := collectCookie(NewHandler(config).PrepareResponse(newCookieTestQuery(cookieTestClientCookie)))
+	resp, err = dns.Exchange(newCookieTestQuery(other), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeBadCookie, resp.Rcode)
+
+	// changing the mode rotates the secret and invalidates the cookie
+	config.SetCookieMode(CookieModeEnforced)
+	resp, err = dns.Exchange(newCookieTestQuery(cookie), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeBadCookie, resp.Rcode)
+
+	// the queries without cookies are answered normally
+	resp, err = dns.Exchange(newCookieTestQuery(""), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, collectCookie(resp))
+
+	state := config.CookieState()
+	assert.Equal(t, 1, state.Valid)
+	assert.Equal(t, 4, state.BadCookie) // including the one of PrepareResponse
+	assert.Equal(t, 1, state.Missing)
+}
+
+func TestHandlerCookieMalformed(t *testing.T) {
+	type testCase struct {
+		name   string
+		cookie string
+	}
+
+	testCases := []testCase{
+		{"client cookie too short", "01020304"},
+		{"server cookie too short", cookieTestClientCookie + "0102"},
+		{"server cookie too long", cookieTestClientCookie + "0102030405060708091011121314151617181920212223242526272829303132" + "33"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, srv := newCookieTestServer(CookieModeEnabled)
+			defer srv.Close()
+			resp, err := dns.Exchange(newCookieTestQuery(tc.cookie), srv.Address())
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeFormatError, resp.Rcode)
+			assert.Equal(t, 1, config.CookieState().FormErr)
+		})
+	}
+}
+
+func TestHandlerCookieModeDisabled(t *testing.T) {
+	config, srv := newCookieTestServer(CookieModeDisabled)
+	defer srv.Close()
+	resp, err := dns.Exchange(newCookieTestQuery(cookieTestClientCookie), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, collectCookie(resp))
+	assert.Equal(t, CookieState{}, config.CookieState())
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/bassosimone/runtimex"
+)
+
+// DDRListenConfig is the [*net.ListenConfig] used by [MustNewDDRServers].
+type DDRListenConfig interface {
+	UDPListenConfig
+	TLSListenConfig
+}
+
+// Ensure that [*net.ListenConfig] implements [DDRListenConfig].
+var _ DDRListenConfig = &net.ListenConfig{}
+
+// DDRResolverName is the name clients query to discover the designated
+// resolvers using the SVCB query type (see RFC 9462).
+const DDRResolverName = "_dns.resolver.arpa."
+
+// DDRDoHPath is the dohpath parameter published by [MustNewDDRServers], which
+// the DNS-over-HTTPS server honours using both GET and POST requests.
+const DDRDoHPath = "/dns-query{?dns}"
+
+// DDRServers is a coordinated set of servers for testing Discovery of
+// Designated Resolvers (DDR) flows, where a client queries [DDRResolverName]
+// using the unencrypted resolver and upgrades to an encrypted one.
+//
+// Construct using [MustNewDDRServers].
+type DDRServers struct {
+	// HTTPS is the designated DNS-over-HTTPS resolver.
+	HTTPS *HTTPSServer
+
+	// TLS is the designated DNS-over-TLS resolver.
+	TLS *TLSServer
+
+	// UDP is the unencrypted DNS-over-UDP resolver.
+	UDP *UDPServer
+}
+
+// MustNewDDRServers starts DNS-over-UDP, DNS-over-TLS, and DNS-over-HTTPS
+// servers listening on the given IP address using random ports, and adds
+// to the config the [DDRResolverName] SVCB records pointing to the encrypted
+// servers, along with the A or AAAA record of the given server name.
+//
+// The DNS-over-TLS record has priority 1 and alpn "dot". The DNS-over-HTTPS
+// record has priority 2, alpn "h2", and dohpath [DDRDoHPath]. Both records
+// use serverName as the target and include the actual port and address hint.
+//
+// For verified discovery (see RFC 9462 Sect. 4.2), the certificate MUST be
+// valid for both the server name and the IP address, which you can obtain
+// with pkitest by setting both DNSNames and IPAddrs.
+//
+// This function PANICS on failure.
+func MustNewDDRServers(lc DDRListenConfig, ipAddr netip.Addr,
+	serverName string, cert tls.Certificate, config *HandlerConfig) *DDRServers {
+	// start the encrypted servers first since the records depend on their ports
+	handler := NewHandler(config)
+	address := net.JoinHostPort(ipAddr.String(), "0")
+	tlsSrv := MustNewTLSServerWithConfig(lc, address, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"dot"},
+	}, handler)
+	httpsSrv := MustNewHTTPSServer(lc, address, cert, handler)
+
+	// populate the designated resolvers records
+	params := &SVCBParams{}
+	if ipAddr.Is4() {
+		params.IPv4Hint = []netip.Addr{ipAddr}
+	} else {
+		params.IPv6Hint = []netip.Addr{ipAddr}
+	}
+	tlsParams := *params
+	tlsParams.ALPN = []string{"dot"}
+	tlsParams.Port = mustParsePort(tlsSrv.address)
+	config.AddSVCB(DDRResolverName, 1, serverName, &tlsParams)
+	httpsParams := *params
+	httpsParams.ALPN = []string{"h2"}
+	httpsParams.DoHPath = DDRDoHPath
+	httpsParams.Port = mustParsePort(httpsSrv.address)
+	config.AddSVCB(DDRResolverName, 2, serverName, &httpsParams)
+	config.AddNetipAddr(serverName, ipAddr)
+
+	// finally start the unencrypted server
+	udpSrv := MustNewUDPServer(lc, address, handler)
+	return &DDRServers{HTTPS: httpsSrv, TLS: tlsSrv, UDP: udpSrv}
+}
+
+// mustParsePort returns the port of the given endpoint address.
+func mustParsePort(address string) uint16 {
+	_, port := runtimex.PanicOnError2(net.SplitHostPort(address))
+	return uint16(runtimex.PanicOnError1(strconv.ParseUint(port, 10, 16)))
+}
+
+// Close closes all the servers.
+func (ds *DDRServers) Close() {
+	ds.UDP.Close()
+	ds.TLS.Close()
+	ds.HTTPS.Close()
+}
@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// ddrTestDesignation is a designated resolver discovered using DDR.
+type ddrTestDesignation struct {
+	alpn    string
+	dohpath string
+	hint    net.IP
+	port    uint16
+	target  string
+}
+
+// discoverDDRTest queries the designated resolvers and returns them by ALPN.
+func discoverDDRTest(t *testing.T, address string) map[string]*ddrTestDesignation {
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   DDRResolverName,
+		Qtype:  dns.TypeSVCB,
+		Qclass: dns.ClassINET,
+	})
+	resp, err := dns.Exchange(query, address)
+	assert.NoError(t, err)
+
+	output := map[string]*ddrTestDesignation{}
+	for _, rr := range resp.Answer {
+		svcb := rr.(*dns.SVCB)
+		entry := &ddrTestDesignation{target: svcb.Target}
+		for _, kv := range svcb.Value {
+			switch kv := kv.(type) {
+			case *dns.SVCBAlpn:
+				entry.alpn = kv.Alpn[0]
+			case *dns.SVCBDoHPath:
+				entry.dohpath = kv.Template
+			case *dns.SVCBIPv4Hint:
+				entry.hint = kv.Hint[0]
+			case *dns.SVCBPort:
+				entry.port = kv.Port
+			}
+		}
+		output[entry.alpn] = entry
+	}
+
+	// the additional section should contain the target address
+	assert.Equal(t, []string{"127.0.0.1"}, collectExtraAddrs(resp))
+	return output
+}
+
+func TestDDRServers(t *testing.T) {
+	// create config
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+
+	// create pki with a certificate valid for the name and the address
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		IPAddrs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Organization: []string{"Example"},
+	})
+
+	// create the servers
+	ipAddr := netip.MustParseAddr("127.0.0.1")
+	servers := MustNewDDRServers(&net.ListenConfig{}, ipAddr, "dns.example.com", cert, config)
+	defer servers.Close()
+
+	// discover the designated resolvers
+	designated := discoverDDRTest(t, servers.UDP.Address())
+	assert.Len(t, designated, 2)
+
+	// create query
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+
+	t.Run("upgrade to DNS-over-TLS", func(t *testing.T) {
+		dot := designated["dot"]
+		assert.NotNil(t, dot)
+		assert.Equal(t, "dns.example.com.", dot.target)
+		assert.Equal(t, servers.TLS.Address(), net.JoinHostPort(dot.hint.String(), strconv.Itoa(int(dot.port))))
+
+		// verified discovery: the certificate must be valid for the unencrypted resolver IP
+		address := net.JoinHostPort(dot.hint.String(), strconv.Itoa(int(dot.port)))
+		tlsCfg := &tls.Config{
+			NextProtos: []string{"dot"},
+			RootCAs:    pki.CertPool(),
+			ServerName: strings.TrimSuffix(dot.target, "."),
+		}
+		conn, err := tls.Dial("tcp", address, tlsCfg)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.NoError(t, conn.ConnectionState().PeerCertificates[0].VerifyHostname(ipAddr.String()))
+		assert.Equal(t, "dot", conn.ConnectionState().NegotiatedProtocol)
+
+		// exchange
+		dconn := &dns.Conn{Conn: conn}
+		err = dconn.WriteMsg(query)
+		assert.NoError(t, err)
+		resp, err := dconn.ReadMsg()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	})
+
+	t.Run("upgrade to DNS-over-HTTPS", func(t *testing.T) {
+		doh := designated["h2"]
+		assert.NotNil(t, doh)
+		assert.Equal(t, DDRDoHPath, doh.dohpath)
+
+		// create the GET request expanding the dohpath template
+		target := strings.TrimSuffix(doh.target, ".")
+		rawQuery := runtimex.PanicOnError1(query.Pack())
+		path := strings.TrimSuffix(doh.dohpath, "{?dns}") + "?dns=" + base64.RawURLEncoding.EncodeToString(rawQuery)
+		URL := "https://" + net.JoinHostPort(target, strconv.Itoa(int(doh.port))) + path
+		httpReq := runtimex.PanicOnError1(http.NewRequest("GET", URL, nil))
+
+		// connect to the hint address rather than resolving the target
+		hint := net.JoinHostPort(doh.hint.String(), strconv.Itoa(int(doh.port)))
+		dialer := &net.Dialer{}
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, hint)
+			},
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{RootCAs: pki.CertPool()},
+		}}
+
+		// exchange
+		httpResp, err := client.Do(httpReq)
+		assert.NoError(t, err)
+		defer httpResp.Body.Close()
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.Equal(t, "HTTP/2.0", httpResp.Proto)
+		rawResp, err := io.ReadAll(httpResp.Body)
+		assert.NoError(t, err)
+		resp := &dns.Msg{}
+		assert.NoError(t, resp.Unpack(rawResp))
+		assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	})
+}
+
+func TestDDRServersWithIPv6(t *testing.T) {
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create the servers, skipping if IPv6 is not available
+	lc := &net.ListenConfig{}
+	conn, err := lc.ListenPacket(context.Background(), "udp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 not available")
+	}
+	conn.Close()
+	config := NewHandlerConfig()
+	servers := MustNewDDRServers(lc, netip.MustParseAddr("::1"), "dns.example.com", cert, config)
+	defer servers.Close()
+
+	// make sure we published an IPv6 hint
+	records, found := config.Lookup(DDRResolverName, dns.TypeSVCB)
+	assert.True(t, found)
+	assert.Len(t, records, 2)
+	for _, rr := range records {
+		assert.Contains(t, rr.String(), `ipv6hint="::1"`)
+	}
+}
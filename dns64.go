@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// DNS64WellKnownPrefix is the well-known NAT64 prefix (see RFC 6052).
+var DNS64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// dns64WellKnownName is the name used for NAT64 prefix discovery (see RFC 7050).
+const dns64WellKnownName = "ipv4only.arpa."
+
+// dns64WellKnownAddrs are the addresses of [dns64WellKnownName] (see RFC 7050).
+var dns64WellKnownAddrs = []netip.Addr{
+	netip.MustParseAddr("192.0.0.170"),
+	netip.MustParseAddr("192.0.0.171"),
+}
+
+// SetDNS64Prefix enables DNS64 (see RFC 6147) using the given NAT64 prefix,
+// e.g., [DNS64WellKnownPrefix], or disables DNS64 when the prefix is the
+// zero value. The prefix length must be 32, 40, 48, 56, 64, or 96.
+//
+// When DNS64 is enabled, the handler synthesizes the AAAA records of the names
+// having A records but no AAAA records, by embedding the IPv4 addresses into
+// the prefix as documented by RFC 6052, unless the query sets both the DO
+// and the CD bits. Additionally, unless configured otherwise, the handler
+// answers ipv4only.arpa using 192.0.0.170 and 192.0.0.171, which allows
+// clients to discover the NAT64 prefix as documented by RFC 7050.
+//
+// This method is safe to call while the handler is running.
+//
+// This method PANICS if the prefix is neither valid nor the zero value.
+func (c *HandlerConfig) SetDNS64Prefix(prefix netip.Prefix) {
+	runtimex.Assert(prefix == netip.Prefix{} || validDNS64Prefix(prefix))
+
+	c.mu.Lock()
+	c.dns64 = prefix.Masked()
+	c.mu.Unlock()
+}
+
+// validDNS64Prefix returns whether the prefix is a valid NAT64 prefix (see RFC 6052).
+func validDNS64Prefix(prefix netip.Prefix) bool {
+	return prefix.IsValid() && prefix.Addr().Is6() && !prefix.Addr().Is4In6() &&
+		slices.Contains([]int{32, 40, 48, 56, 64, 96}, prefix.Bits())
+}
+
+// dns64Prefix returns the NAT64 prefix, which is invalid when DNS64 is disabled.
+func (c *HandlerConfig) dns64Prefix() netip.Prefix {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dns64
+}
+
+// lookupDNS64WellKnown returns the records of ipv4only.arpa when DNS64
+// is enabled and the name does not exist, using the same return values
+// of [*HandlerConfig.Lookup].
+func (c *HandlerConfig) lookupDNS64WellKnown(name string, qtype uint16) ([]dns.RR, bool) {
+	if dns.CanonicalName(name) != dns64WellKnownName || !c.dns64Prefix().IsValid() {
+		return nil, false
+	}
+	if _, found := c.Lookup(name, qtype); found {
+		return nil, false
+	}
+	var records []dns.RR
+	if qtype == dns.TypeA {
+		for _, addr := range dns64WellKnownAddrs {
+			records = append(records, newNetipAddrRR(dns64WellKnownName, addr))
+		}
+	}
+	return records, true
+}
+
+// synthesizeDNS64 returns the AAAA records synthesized from the A records of
+// the given name, which does not have AAAA records, or nil when DNS64 is
+// disabled, the query sets both the DO and the CD bits, or there are no
+// A records. The records are ordered according to the [RecordOrder].
+func (c *HandlerConfig) synthesizeDNS64(name string, query *dns.Msg) []dns.RR {
+	// 1. make sure we should synthesize
+	prefix := c.dns64Prefix()
+	if !prefix.IsValid() {
+		return nil
+	}
+	if opt := query.IsEdns0(); opt != nil && opt.Do() && query.CheckingDisabled {
+		return nil
+	}
+
+	// 2. find the A records like we would do for an A query
+	records, found := c.Lookup(name, dns.TypeA)
+	if !found {
+		records, _ = c.lookupDNS64WellKnown(name, dns.TypeA)
+	}
+	if subnetRecords, _ := c.lookupSubnet(name, dns.TypeA, query); len(subnetRecords) > 0 {
+		records = subnetRecords
+	}
+
+	// 3. embed the addresses into the prefix
+	var output []dns.RR
+	for _, rr := range records {
+		rr, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rr.A)
+		if !ok {
+			continue
+		}
+		output = append(output, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   rr.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    rr.Hdr.Ttl,
+			},
+			AAAA: dns64Embed(prefix, addr.Unmap()).AsSlice(),
+		})
+	}
+	return c.applyRecordOrder(name, output)
+}
+
+// dns64Embed embeds the IPv4 address into the NAT64 prefix as documented by
+// RFC 6052, which requires skipping the bits 64 to 71 of the IPv6 address.
+func dns64Embed(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	output := prefix.Addr().As16()
+	offset := prefix.Bits() / 8
+	for _, octet := range addr.As4() {
+		if offset == 8 {
+			offset++
+		}
+		output[offset] = octet
+		offset++
+	}
+	return netip.AddrFrom16(output)
+}
@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNS64Embed(t *testing.T) {
+	// See RFC 6052 Section 2.4
+	type testCase struct {
+		prefix string
+		expect string
+	}
+
+	testCases := []testCase{
+		{prefix: "2001:db8::/32", expect: "2001:db8:c000:221::"},
+		{prefix: "2001:db8:100::/40", expect: "2001:db8:1c0:2:21::"},
+		{prefix: "2001:db8:122::/48", expect: "2001:db8:122:c000:2:2100::"},
+		{prefix: "2001:db8:122:300::/56", expect: "2001:db8:122:3c0:0:221::"},
+		{prefix: "2001:db8:122:344::/64", expect: "2001:db8:122:344:c0:2:2100:0"},
+		{prefix: "2001:db8:122:344::/96", expect: "2001:db8:122:344::c000:221"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.prefix, func(t *testing.T) {
+			got := dns64Embed(netip.MustParsePrefix(tc.prefix), netip.MustParseAddr("192.0.2.33"))
+			assert.Equal(t, netip.MustParseAddr(tc.expect), got)
+		})
+	}
+}
+
+func TestHandlerDNS64(t *testing.T) {
+	type testCase struct {
+		name         string
+		prefix       netip.Prefix
+		getQuery     func() *dns.Msg
+		expectRcode  int
+		expectAnswer []string
+	}
+
+	// newQuery creates a query for the given name and type.
+	newQuery := func(name string, qtype uint16) func() *dns.Msg {
+		return func() *dns.Msg {
+			return newDNSSECTestQuery(name, qtype, false)
+		}
+	}
+
+	testCases := []testCase{
+		{
+			name:         "synthesis with the well-known prefix",
+			prefix:       DNS64WellKnownPrefix,
+			getQuery:     newQuery("v4only.example.com", dns.TypeAAAA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"64:ff9b::c000:221", "64:ff9b::c000:222"},
+		},
+
+		{
+			name:         "synthesis with a custom prefix",
+			prefix:       netip.MustParsePrefix("2001:db8:122:344::/64"),
+			getQuery:     newQuery("v4only.example.com", dns.TypeAAAA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"2001:db8:122:344:c0:2:2100:0", "2001:db8:122:344:c0:2:2200:0"},
+		},
+
+		{
+			name:         "synthesis through a CNAME",
+			prefix:       DNS64WellKnownPrefix,
+			getQuery:     newQuery("alias.example.com", dns.TypeAAAA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"64:ff9b::c000:221", "64:ff9b::c000:222"},
+		},
+
+		{
+			name:         "native AAAA records win",
+			prefix:       DNS64WellKnownPrefix,
+			getQuery:     newQuery("dualstack.example.com", dns.TypeAAAA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"2001:db8::1"},
+		},
+
+		{
+			name:         "A queries are unaffected",
+			prefix:       DNS64WellKnownPrefix,
+			getQuery:     newQuery("v4only.example.com", dns.TypeA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"192.0.2.33", "192.0.2.34"},
+		},
+
+		{
+			name:         "NXDOMAIN is unaffected",
+			prefix:       DNS64WellKnownPrefix,
+			getQuery:     newQuery("nonexistent.example.com", dns.TypeAAAA),
+			expectRcode:  dns.RcodeNameError,
+			expectAnswer: nil,
+		},
+
+		{
+			name:   "no synthesis with DO and CD",
+			prefix: DNS64WellKnownPrefix,
+			getQuery: func() *dns.Msg {
+				query := newDNSSECTestQuery("v4only.example.com", dns.TypeAAAA, true)
+				query.CheckingDisabled = true
+				return query
+			},
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: nil,
+		},
+
+		{
+			name:         "no synthesis when disabled",
+			getQuery:     newQuery("v4only.example.com", dns.TypeAAAA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: nil,
+		},
+
+		{
+			name:         "ipv4only.arpa AAAA",
+			prefix:       netip.MustParsePrefix("2001:db8:64::/96"),
+			getQuery:     newQuery("ipv4only.arpa", dns.TypeAAAA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"2001:db8:64::c000:aa", "2001:db8:64::c000:ab"},
+		},
+
+		{
+			name:         "ipv4only.arpa A",
+			prefix:       DNS64WellKnownPrefix,
+			getQuery:     newQuery("ipv4only.arpa", dns.TypeA),
+			expectRcode:  dns.RcodeSuccess,
+			expectAnswer: []string{"192.0.0.170", "192.0.0.171"},
+		},
+
+		{
+			name:         "ipv4only.arpa when disabled",
+			getQuery:     newQuery("ipv4only.arpa", dns.TypeAAAA),
+			expectRcode:  dns.RcodeNameError,
+			expectAnswer: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// create config
+			config := NewHandlerConfig()
+			config.AddNetipAddr("v4only.example.com", netip.MustParseAddr("192.0.2.33"))
+			config.AddNetipAddr("v4only.example.com", netip.MustParseAddr("192.0.2.34"))
+			config.AddCNAME("alias.example.com", "v4only.example.com")
+			config.AddNetipAddr("dualstack.example.com", netip.MustParseAddr("192.0.2.1"))
+			config.AddNetipAddr("dualstack.example.com", netip.MustParseAddr("2001:db8::1"))
+			config.SetDNS64Prefix(tc.prefix)
+
+			// query and collect the addresses
+			resp := NewHandler(config).PrepareResponse(tc.getQuery())
+			assert.Equal(t, tc.expectRcode, resp.Rcode)
+			assert.Equal(t, tc.expectAnswer, collectAddrs(resp))
+		})
+	}
+}
+
+func TestHandlerConfigDNS64Configured(t *testing.T) {
+	// the records of ipv4only.arpa we configure take precedence
+	config := NewHandlerConfig()
+	config.AddNetipAddr("ipv4only.arpa", netip.MustParseAddr("192.0.2.1"))
+	config.SetDNS64Prefix(DNS64WellKnownPrefix)
+	resp := NewHandler(config.Clone()).PrepareResponse(newDNSSECTestQuery("ipv4only.arpa", dns.TypeAAAA, false))
+	assert.Equal(t, []string{"64:ff9b::c000:201"}, collectAddrs(resp))
+
+	// disabling DNS64 removes the synthesized records
+	config.SetDNS64Prefix(netip.Prefix{})
+	resp = NewHandler(config).PrepareResponse(newDNSSECTestQuery("ipv4only.arpa", dns.TypeAAAA, false))
+	assert.Empty(t, collectAddrs(resp))
+}
+
+func TestHandlerConfigSetDNS64PrefixInvalid(t *testing.T) {
+	for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/24", "::ffff:0:0/96"} {
+		t.Run(prefix, func(t *testing.T) {
+			assert.Panics(t, func() {
+				NewHandlerConfig().SetDNS64Prefix(netip.MustParsePrefix(prefix))
+			})
+		})
+	}
+}
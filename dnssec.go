@@ -0,0 +1,312 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// SignedZone is a zone that [*Handler] signs on the fly using DNSSEC.
+//
+// Construct using [*HandlerConfig.SignZone].
+type SignedZone struct {
+	// fault is the DNSSECFault to inject.
+	fault DNSSECFault
+
+	// faultKey is the unpublished or weak key used by some faults.
+	faultKey *dns.DNSKEY
+
+	// faultPriv is the faultKey private key.
+	faultPriv crypto.Signer
+
+	// ksk is the key signing key.
+	ksk *dns.DNSKEY
+
+	// kskPriv is the key signing key private key.
+	kskPriv crypto.Signer
+
+	// mu protects the fault fields.
+	mu sync.Mutex
+
+	// name is the zone name.
+	name string
+
+	// nsec3 contains the NSEC3 parameters or nil when using NSEC.
+	nsec3 *NSEC3Params
+
+	// zsk is the zone signing key.
+	zsk *dns.DNSKEY
+
+	// zskPriv is the zone signing key private key.
+	zskPriv crypto.Signer
+}
+
+// signedZoneNegativeTTL is the SOA minimum TTL of a [*SignedZone], which
+// is also the TTL of the NSEC and NSEC3 records.
+const signedZoneNegativeTTL = 300
+
+// Signature validity used by [*SignedZone] relative to the signing time.
+const (
+	signedZoneInception  = -time.Hour
+	signedZoneExpiration = 7 * 24 * time.Hour
+)
+
+// mustNewDNSKEY generates a new ECDSAP256SHA256 [*dns.DNSKEY] with the given flags.
+func mustNewDNSKEY(zone string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    handlerDefaultTTL,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv := runtimex.PanicOnError1(key.Generate(256))
+	return key, priv.(crypto.Signer)
+}
+
+// SignZone enables DNSSEC for the given zone and returns the [*SignedZone].
+//
+// We generate a key signing key and a zone signing key, both using
+// ECDSAP256SHA256, and add to the config the SOA and DNSKEY records at
+// the zone apex along with the DS record, which the handler serves on
+// behalf of the parent zone. When the parent zone is also signed, it
+// signs the DS record, thus establishing the chain of trust. Otherwise,
+// use [*SignedZone.TrustAnchor] to configure the validator.
+//
+// When the query sets the DO bit, the handler signs the RRsets whose
+// owner name belongs to a signed zone. The handler uses the most specific
+// signed zone containing the owner name, except for DS records, which are
+// signed by the parent zone.
+//
+// Negative answers include the SOA record in the authority section and,
+// when the query sets the DO bit, the NSEC records proving the denial
+// of existence. Use [*HandlerConfig.SignZoneWithNSEC3] for NSEC3.
+//
+// Use [*SignedZone.SetFault] to simulate a broken zone.
+//
+// This method PANICS on failure.
+func (c *HandlerConfig) SignZone(zone string) *SignedZone {
+	return c.signZone(zone, nil)
+}
+
+// SignZoneWithNSEC3 is like [*HandlerConfig.SignZone] but uses NSEC3
+// with the given parameters to prove the denial of existence, and adds
+// the corresponding NSEC3PARAM record at the zone apex.
+//
+// This method PANICS on failure.
+func (c *HandlerConfig) SignZoneWithNSEC3(zone string, params *NSEC3Params) *SignedZone {
+	runtimex.Assert(params != nil)
+	return c.signZone(zone, params)
+}
+
+// signZone implements [*HandlerConfig.SignZone] and [*HandlerConfig.SignZoneWithNSEC3].
+func (c *HandlerConfig) signZone(zone string, params *NSEC3Params) *SignedZone {
+	zone = dns.CanonicalName(zone)
+	ksk, kskPriv := mustNewDNSKEY(zone, dns.ZONE|dns.SEP)
+	zsk, zskPriv := mustNewDNSKEY(zone, dns.ZONE)
+	sz := &SignedZone{
+		ksk:     ksk,
+		kskPriv: kskPriv,
+		name:    zone,
+		nsec3:   params,
+		zsk:     zsk,
+		zskPriv: zskPriv,
+	}
+	records := []dns.RR{newSignedZoneSOA(zone), ksk, zsk, sz.TrustAnchor()}
+	if params != nil {
+		records = append(records, params.newNSEC3PARAM(zone))
+	}
+
+	c.mu.Lock()
+	c.addRRsLocked(zone, records...)
+	c.zones[zone] = sz
+	c.mu.Unlock()
+	return sz
+}
+
+// newSignedZoneSOA returns the SOA record of a [*SignedZone].
+func newSignedZoneSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    handlerDefaultTTL,
+		},
+		Ns:      "ns." + strings.TrimPrefix(zone, "."),
+		Mbox:    "hostmaster." + strings.TrimPrefix(zone, "."),
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		Minttl:  signedZoneNegativeTTL,
+	}
+}
+
+// Name returns the zone name.
+func (sz *SignedZone) Name() string {
+	return sz.name
+}
+
+// KSK returns a copy of the key signing key.
+func (sz *SignedZone) KSK() *dns.DNSKEY {
+	return dns.Copy(sz.ksk).(*dns.DNSKEY)
+}
+
+// TrustAnchor returns the DS record of the key signing key using SHA-256,
+// which you can use to configure the trust anchor of the validator.
+func (sz *SignedZone) TrustAnchor() *dns.DS {
+	ds := sz.ksk.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = handlerDefaultTTL
+	return ds
+}
+
+// sign returns the [*dns.RRSIG] for the given RRset, which MUST be non-empty,
+// or nil when the [DNSSECFault] requires stripping the signatures.
+func (sz *SignedZone) sign(rrset []dns.RR, now time.Time) *dns.RRSIG {
+	sz.mu.Lock()
+	fault, faultKey, faultPriv := sz.fault, sz.faultKey, sz.faultPriv
+	sz.mu.Unlock()
+
+	key, priv := sz.zsk, sz.zskPriv
+	inception, expiration := now.Add(signedZoneInception), now.Add(signedZoneExpiration)
+	switch {
+	case fault == DNSSECFaultAlgorithmDowngrade:
+		key, priv = faultKey, faultPriv
+	case rrset[0].Header().Rrtype == dns.TypeDNSKEY:
+		key, priv = sz.ksk, sz.kskPriv
+	case fault == DNSSECFaultUnknownKey:
+		key, priv = faultKey, faultPriv
+	}
+	switch fault {
+	case DNSSECFaultExpiredSignatures:
+		inception, expiration = now.Add(-signedZoneExpiration), now.Add(signedZoneInception)
+	case DNSSECFaultStrippedSignatures:
+		return nil
+	}
+
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrset[0].Header().Ttl,
+		},
+		Algorithm:  key.Algorithm,
+		Expiration: uint32(expiration.Unix()),
+		Inception:  uint32(inception.Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: sz.name,
+	}
+	runtimex.PanicOnError0(sig.Sign(priv, rrset))
+	return sig
+}
+
+// findZone returns the most specific [*SignedZone] for the given RRset
+// owner name and type, or nil when the RRset does not belong to a signed zone.
+func (c *HandlerConfig) findZone(name string, rrtype uint16) *SignedZone {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.findZoneLocked(dns.CanonicalName(name), rrtype)
+}
+
+// findZoneLocked is like findZone but requires a canonical name.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) findZoneLocked(name string, rrtype uint16) *SignedZone {
+	if rrtype == dns.TypeDS {
+		// the DS records belong to the parent zone
+		if name == "." {
+			return nil
+		}
+		_, parent, _ := strings.Cut(name, ".")
+		name = dns.CanonicalName(parent)
+	}
+
+	for {
+		if sz, found := c.zones[name]; found {
+			return sz
+		}
+		if name == "." {
+			return nil
+		}
+		_, parent, _ := strings.Cut(name, ".")
+		name = dns.CanonicalName(parent)
+	}
+}
+
+// rrsetKey identifies an RRset within a message section.
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// signSection returns the section followed by the RRSIGs of its RRsets belonging to signed zones.
+func (c *HandlerConfig) signSection(section []dns.RR, now time.Time) []dns.RR {
+	// group the records into RRsets preserving the order
+	var keys []rrsetKey
+	rrsets := map[rrsetKey][]dns.RR{}
+	for _, rr := range section {
+		key := rrsetKey{name: dns.CanonicalName(rr.Header().Name), rrtype: rr.Header().Rrtype}
+		if key.rrtype == dns.TypeRRSIG || key.rrtype == dns.TypeOPT {
+			continue
+		}
+		if _, found := rrsets[key]; !found {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	// sign each RRset belonging to a signed zone
+	output := section
+	for _, key := range keys {
+		sz := c.findZone(key.name, key.rrtype)
+		if sz == nil {
+			continue
+		}
+		if sig := c.signRRset(sz, rrsets[key], now); sig != nil {
+			output = append(output, sig)
+		}
+	}
+	return output
+}
+
+// signRRset is like [*SignedZone.sign] but handles wildcards.
+//
+// When we synthesized the RRset from a wildcard, we sign the wildcard RRset
+// such that the RRSIG labels field allows validators to reconstruct it.
+func (c *HandlerConfig) signRRset(sz *SignedZone, rrset []dns.RR, now time.Time) *dns.RRSIG {
+	name := dns.CanonicalName(rrset[0].Header().Name)
+	c.mu.Lock()
+	wildcard, found := c.wildcardLocked(name)
+	c.mu.Unlock()
+	if !found || rrset[0].Header().Rrtype == dns.TypeNSEC3 {
+		return sz.sign(rrset, now)
+	}
+	var synthesized []dns.RR
+	for _, rr := range rrset {
+		rr = dns.Copy(rr)
+		rr.Header().Name = wildcard
+		synthesized = append(synthesized, rr)
+	}
+	sig := sz.sign(synthesized, now)
+	if sig != nil {
+		sig.Hdr.Name = name
+	}
+	return sig
+}
+
+// signResponse adds the RRSIGs to all the sections of the response.
+func (c *HandlerConfig) signResponse(resp *dns.Msg) {
+	now := time.Now()
+	resp.Answer = c.signSection(resp.Answer, now)
+	resp.Ns = c.signSection(resp.Ns, now)
+	resp.Extra = c.signSection(resp.Extra, now)
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newDNSSECTestQuery creates a query for the given name and type with the given DO bit.
+func newDNSSECTestQuery(name string, qtype uint16, do bool) *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion(dns.CanonicalName(name), qtype)
+	query.SetEdns0(handlerEDNS0Size, do)
+	return query
+}
+
+// collectRRSIGs returns the RRSIGs within the given section.
+func collectRRSIGs(section []dns.RR) (output []*dns.RRSIG) {
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			output = append(output, sig)
+		}
+	}
+	return
+}
+
+// verifyRRSIG verifies the given RRSIG over the records it covers within the given section.
+func verifyRRSIG(t *testing.T, key *dns.DNSKEY, sig *dns.RRSIG, section []dns.RR) {
+	var rrset []dns.RR
+	for _, rr := range section {
+		if rr.Header().Rrtype == sig.TypeCovered && dns.CanonicalName(rr.Header().Name) == sig.Hdr.Name {
+			rrset = append(rrset, rr)
+		}
+	}
+	assert.NotEmpty(t, rrset)
+	assert.Equal(t, key.KeyTag(), sig.KeyTag)
+	assert.NoError(t, sig.Verify(key, rrset))
+	assert.True(t, sig.ValidityPeriod(time.Now()))
+}
+
+func TestHandlerDNSSEC(t *testing.T) {
+	// create config with a signed zone
+	config := NewHandlerConfig()
+	zone := config.SignZone("example.com")
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("172.66.144.113"))
+	config.AddCNAME("alias.example.com", "www.example.org")
+	config.AddNetipAddr("www.example.org", netip.MustParseAddr("8.8.8.8"))
+	handler := NewHandler(config)
+
+	// obtain the zone keys
+	resp := handler.PrepareResponse(newDNSSECTestQuery("example.com", dns.TypeDNSKEY, true))
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	keys := map[uint16]*dns.DNSKEY{}
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys[key.Flags] = key
+		}
+	}
+	ksk, zsk := keys[dns.ZONE|dns.SEP], keys[dns.ZONE]
+	assert.NotNil(t, ksk)
+	assert.NotNil(t, zsk)
+
+	t.Run("DNSKEY is signed by the KSK matching the trust anchor", func(t *testing.T) {
+		assert.Equal(t, "example.com.", zone.Name())
+		assert.Equal(t, zone.KSK().String(), ksk.String())
+		assert.Equal(t, zone.TrustAnchor().Digest, ksk.ToDS(dns.SHA256).Digest)
+		sigs := collectRRSIGs(resp.Answer)
+		assert.Len(t, sigs, 1)
+		verifyRRSIG(t, ksk, sigs[0], resp.Answer)
+	})
+
+	t.Run("A is signed by the ZSK when DO is set", func(t *testing.T) {
+		resp := handler.PrepareResponse(newDNSSECTestQuery("www.example.com", dns.TypeA, true))
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, []string{"104.20.34.220", "172.66.144.113"}, collectAddrs(resp))
+		sigs := collectRRSIGs(resp.Answer)
+		assert.Len(t, sigs, 1)
+		assert.Equal(t, dns.TypeA, sigs[0].TypeCovered)
+		assert.Equal(t, "example.com.", sigs[0].SignerName)
+		verifyRRSIG(t, zsk, sigs[0], resp.Answer)
+		assert.True(t, resp.IsEdns0().Do())
+	})
+
+	t.Run("A is not signed when DO is not set", func(t *testing.T) {
+		resp := handler.PrepareResponse(newDNSSECTestQuery("www.example.com", dns.TypeA, false))
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Empty(t, collectRRSIGs(resp.Answer))
+		assert.NotNil(t, resp.IsEdns0())
+		assert.False(t, resp.IsEdns0().Do())
+	})
+
+	t.Run("there is no OPT without EDNS0", func(t *testing.T) {
+		query := &dns.Msg{}
+		query.SetQuestion("www.example.com.", dns.TypeA)
+		resp := handler.PrepareResponse(query)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Nil(t, resp.IsEdns0())
+	})
+
+	t.Run("only the RRsets in signed zones are signed", func(t *testing.T) {
+		resp := handler.PrepareResponse(newDNSSECTestQuery("alias.example.com", dns.TypeA, true))
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, []string{"8.8.8.8"}, collectAddrs(resp))
+		sigs := collectRRSIGs(resp.Answer)
+		assert.Len(t, sigs, 1)
+		assert.Equal(t, dns.TypeCNAME, sigs[0].TypeCovered)
+		verifyRRSIG(t, zsk, sigs[0], resp.Answer)
+	})
+}
+
+func TestHandlerDNSSECChainOfTrust(t *testing.T) {
+	// create config with a signed parent and a signed child
+	config := NewHandlerConfig()
+	parent := config.SignZone("com")
+	child := config.SignZone("example.com")
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+
+	// create server
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config))
+	defer srv.Close()
+
+	// query for the DS of the child
+	resp, err := dns.Exchange(newDNSSECTestQuery("example.com", dns.TypeDS, true), srv.Address())
+	assert.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	// the DS must match the child KSK
+	var ds *dns.DS
+	for _, rr := range resp.Answer {
+		if rr, ok := rr.(*dns.DS); ok {
+			ds = rr
+		}
+	}
+	assert.NotNil(t, ds)
+	assert.Equal(t, child.TrustAnchor().Digest, ds.Digest)
+
+	// the DS must be signed by the parent ZSK
+	resp2, err := dns.Exchange(newDNSSECTestQuery("com", dns.TypeDNSKEY, true), srv.Address())
+	assert.NoError(t, err)
+	var parentZSK *dns.DNSKEY
+	for _, rr := range resp2.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && key.Flags == dns.ZONE {
+			parentZSK = key
+		}
+	}
+	assert.NotNil(t, parentZSK)
+	sigs := collectRRSIGs(resp.Answer)
+	assert.Len(t, sigs, 1)
+	assert.Equal(t, parent.Name(), sigs[0].SignerName)
+	verifyRRSIG(t, parentZSK, sigs[0], resp.Answer)
+}
+
+func TestHandlerConfigCloneKeepsSignedZones(t *testing.T) {
+	config := NewHandlerConfig()
+	config.SignZone("example.com")
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+
+	resp := NewHandler(config.Clone()).PrepareResponse(
+		newDNSSECTestQuery("www.example.com", dns.TypeA, true))
+	assert.Len(t, collectRRSIGs(resp.Answer), 1)
+}
+
+func TestHandlerConfigFindZone(t *testing.T) {
+	config := NewHandlerConfig()
+	config.SignZone("example.com")
+
+	assert.Nil(t, config.findZone(".", dns.TypeDS))
+	assert.Nil(t, config.findZone(".", dns.TypeA))
+	assert.Nil(t, config.findZone("example.com", dns.TypeDS))
+	assert.Equal(t, "example.com.", config.findZone("example.com", dns.TypeA).Name())
+	assert.Equal(t, "example.com.", config.findZone("a.b.EXAMPLE.com", dns.TypeDS).Name())
+	assert.Nil(t, config.findZone("example.org", dns.TypeA))
+}
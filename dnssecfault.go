@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto"
+	"encoding/hex"
+	"strings"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// DNSSECFault is a DNSSEC fault injected by [*Handler] for a [*SignedZone],
+// which allows to test the bogus and SERVFAIL paths of validators.
+type DNSSECFault int
+
+const (
+	// DNSSECFaultNone disables DNSSEC faults.
+	DNSSECFaultNone = DNSSECFault(iota)
+
+	// DNSSECFaultExpiredSignatures generates RRSIGs whose
+	// validity period ended before the signing time.
+	DNSSECFaultExpiredSignatures
+
+	// DNSSECFaultUnknownKey signs all the RRsets but the DNSKEY RRset
+	// using a key that is not published in the DNSKEY RRset.
+	DNSSECFaultUnknownKey
+
+	// DNSSECFaultMissingDNSKEY removes the DNSKEY RRset from the
+	// responses, while the parent zone still serves the DS.
+	DNSSECFaultMissingDNSKEY
+
+	// DNSSECFaultDSMismatch serves, on behalf of the parent zone,
+	// a DS whose digest does not match the key signing key.
+	DNSSECFaultDSMismatch
+
+	// DNSSECFaultAlgorithmDowngrade signs all the RRsets, including the
+	// DNSKEY RRset, using only a RSASHA1 key, which is published in the
+	// DNSKEY RRset but uses an algorithm not listed in the DS, thus
+	// simulating an attacker stripping the signatures using the stronger
+	// algorithm (see RFC 6840 Section 5.11).
+	DNSSECFaultAlgorithmDowngrade
+
+	// DNSSECFaultStrippedSignatures omits all the RRSIGs of the zone.
+	DNSSECFaultStrippedSignatures
+)
+
+// dnssecFaultDowngradeBits is the RSA key size used by [DNSSECFaultAlgorithmDowngrade].
+const dnssecFaultDowngradeBits = 1024
+
+// SetFault sets the [DNSSECFault] to inject for this zone.
+//
+// This method is safe to call while the handler is running.
+//
+// This method PANICS on failure.
+func (sz *SignedZone) SetFault(fault DNSSECFault) {
+	var (
+		key  *dns.DNSKEY
+		priv crypto.Signer
+	)
+	switch fault {
+	case DNSSECFaultNone, DNSSECFaultExpiredSignatures, DNSSECFaultMissingDNSKEY,
+		DNSSECFaultDSMismatch, DNSSECFaultStrippedSignatures:
+		// nothing
+
+	case DNSSECFaultUnknownKey:
+		key, priv = mustNewDNSKEY(sz.name, dns.ZONE)
+
+	case DNSSECFaultAlgorithmDowngrade:
+		key = &dns.DNSKEY{
+			Hdr:       sz.zsk.Hdr,
+			Flags:     dns.ZONE,
+			Protocol:  3,
+			Algorithm: dns.RSASHA1,
+		}
+		priv = runtimex.PanicOnError1(key.Generate(dnssecFaultDowngradeBits)).(crypto.Signer)
+
+	default:
+		panic("dnstest: unknown DNSSECFault")
+	}
+
+	sz.mu.Lock()
+	sz.fault, sz.faultKey, sz.faultPriv = fault, key, priv
+	sz.mu.Unlock()
+}
+
+// Fault returns the [DNSSECFault] injected for this zone.
+func (sz *SignedZone) Fault() DNSSECFault {
+	sz.mu.Lock()
+	defer sz.mu.Unlock()
+	return sz.fault
+}
+
+// applyDNSSECFaults modifies the records of the response according to the
+// [DNSSECFault] of each zone. The faults affecting the signatures are
+// instead applied when signing (see [*SignedZone.sign]).
+func (c *HandlerConfig) applyDNSSECFaults(resp *dns.Msg) {
+	resp.Answer = c.applyDNSSECFaultsSection(resp.Answer)
+	resp.Ns = c.applyDNSSECFaultsSection(resp.Ns)
+	resp.Extra = c.applyDNSSECFaultsSection(resp.Extra)
+}
+
+// applyDNSSECFaultsSection implements applyDNSSECFaults for a single section.
+func (c *HandlerConfig) applyDNSSECFaultsSection(section []dns.RR) []dns.RR {
+	var output []dns.RR
+	for _, rr := range section {
+		// 1. find the zone whose apex owns the record
+		name := dns.CanonicalName(rr.Header().Name)
+		c.mu.Lock()
+		sz := c.zones[name]
+		c.mu.Unlock()
+		if sz == nil {
+			output = append(output, rr)
+			continue
+		}
+
+		// 2. apply the fault
+		sz.mu.Lock()
+		fault, faultKey := sz.fault, sz.faultKey
+		sz.mu.Unlock()
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			switch fault {
+			case DNSSECFaultMissingDNSKEY:
+				continue
+			case DNSSECFaultAlgorithmDowngrade:
+				// note: the DNSKEY RRset contains the ZSK after the KSK
+				if rr.Flags == dns.ZONE {
+					output = append(output, rr, dns.Copy(faultKey))
+					continue
+				}
+			}
+
+		case *dns.DS:
+			if fault == DNSSECFaultDSMismatch {
+				ds := dns.Copy(rr).(*dns.DS)
+				digest := runtimex.PanicOnError1(hex.DecodeString(ds.Digest))
+				for idx := range digest {
+					digest[idx] ^= 0xff
+				}
+				ds.Digest = strings.ToUpper(hex.EncodeToString(digest))
+				output = append(output, ds)
+				continue
+			}
+		}
+		output = append(output, rr)
+	}
+	return output
+}
@@ -0,0 +1,225 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// collectDNSKEYs returns the DNSKEYs within the answer section.
+func collectDNSKEYs(resp *dns.Msg) (output []*dns.DNSKEY) {
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			output = append(output, key)
+		}
+	}
+	return
+}
+
+// validateChain validates the RRset of the given name and type starting
+// from the given DS of its zone, like a validator would do, by verifying
+// the DNSKEY RRset using the key matching the DS and then the RRset using
+// a key of the authenticated DNSKEY RRset.
+func validateChain(handler *Handler, ds *dns.DS, name string, qtype uint16) error {
+	// 1. find the key signing key matching the DS
+	resp := handler.PrepareResponse(newDNSSECTestQuery(ds.Hdr.Name, dns.TypeDNSKEY, true))
+	keys := collectDNSKEYs(resp)
+	var ksk *dns.DNSKEY
+	for _, key := range keys {
+		if candidate := key.ToDS(ds.DigestType); candidate != nil && candidate.Digest == ds.Digest {
+			ksk = key
+		}
+	}
+	if ksk == nil {
+		return errors.New("no DNSKEY matches the DS")
+	}
+
+	// 2. authenticate the DNSKEY RRset using the key signing key
+	var dnskeys []dns.RR
+	for _, key := range keys {
+		dnskeys = append(dnskeys, key)
+	}
+	if err := verifyAnyRRSIG([]*dns.DNSKEY{ksk}, resp.Answer, dnskeys); err != nil {
+		return fmt.Errorf("DNSKEY: %w", err)
+	}
+
+	// 3. authenticate the RRset using the authenticated DNSKEY RRset
+	resp = handler.PrepareResponse(newDNSSECTestQuery(name, qtype, true))
+	var rrset []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			rrset = append(rrset, rr)
+		}
+	}
+	if err := verifyAnyRRSIG(keys, resp.Answer, rrset); err != nil {
+		return fmt.Errorf("%s: %w", dns.TypeToString[qtype], err)
+	}
+	return nil
+}
+
+// verifyAnyRRSIG returns nil when at least one RRSIG within the section
+// covering the RRset verifies using one of the given keys.
+func verifyAnyRRSIG(keys []*dns.DNSKEY, section, rrset []dns.RR) error {
+	if len(rrset) <= 0 {
+		return errors.New("empty RRset")
+	}
+	for _, sig := range collectRRSIGs(section) {
+		if sig.TypeCovered != rrset[0].Header().Rrtype {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrset) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("no valid RRSIG")
+}
+
+func TestSignedZoneSetFault(t *testing.T) {
+	type testCase struct {
+		name     string
+		fault    DNSSECFault
+		validate func(t *testing.T, handler *Handler, parent, child *SignedZone)
+	}
+
+	// query sends a query with the DO bit set.
+	query := func(handler *Handler, name string, qtype uint16) *dns.Msg {
+		return handler.PrepareResponse(newDNSSECTestQuery(name, qtype, true))
+	}
+
+	testCases := []testCase{
+		{
+			name:  "DNSSECFaultNone",
+			fault: DNSSECFaultNone,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				keys := collectDNSKEYs(query(handler, "example.com", dns.TypeDNSKEY))
+				assert.Len(t, keys, 2)
+				resp := query(handler, "www.example.com", dns.TypeA)
+				sigs := collectRRSIGs(resp.Answer)
+				assert.Len(t, sigs, 1)
+				verifyRRSIG(t, keys[1], sigs[0], resp.Answer)
+				assert.NoError(t, validateChain(handler, child.TrustAnchor(), "www.example.com", dns.TypeA))
+			},
+		},
+
+		{
+			name:  "DNSSECFaultExpiredSignatures",
+			fault: DNSSECFaultExpiredSignatures,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				keys := collectDNSKEYs(query(handler, "example.com", dns.TypeDNSKEY))
+				resp := query(handler, "www.example.com", dns.TypeA)
+				sigs := collectRRSIGs(resp.Answer)
+				assert.Len(t, sigs, 1)
+				assert.False(t, sigs[0].ValidityPeriod(time.Now()))
+				assert.NoError(t, sigs[0].Verify(keys[1], resp.Answer[:1]))
+			},
+		},
+
+		{
+			name:  "DNSSECFaultUnknownKey",
+			fault: DNSSECFaultUnknownKey,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				resp := query(handler, "example.com", dns.TypeDNSKEY)
+				keys := collectDNSKEYs(resp)
+				assert.Len(t, keys, 2)
+				verifyRRSIG(t, child.KSK(), collectRRSIGs(resp.Answer)[0], resp.Answer)
+				resp = query(handler, "www.example.com", dns.TypeA)
+				sigs := collectRRSIGs(resp.Answer)
+				assert.Len(t, sigs, 1)
+				for _, key := range keys {
+					assert.NotEqual(t, key.KeyTag(), sigs[0].KeyTag)
+				}
+			},
+		},
+
+		{
+			name:  "DNSSECFaultMissingDNSKEY",
+			fault: DNSSECFaultMissingDNSKEY,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				resp := query(handler, "example.com", dns.TypeDNSKEY)
+				assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+				assert.Empty(t, collectDNSKEYs(resp))
+				resp = query(handler, "example.com", dns.TypeDS)
+				assert.Len(t, resp.Answer, 2)
+			},
+		},
+
+		{
+			name:  "DNSSECFaultDSMismatch",
+			fault: DNSSECFaultDSMismatch,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				resp := query(handler, "example.com", dns.TypeDS)
+				ds := resp.Answer[0].(*dns.DS)
+				assert.NotEqual(t, child.TrustAnchor().Digest, ds.Digest)
+				assert.Len(t, ds.Digest, len(child.TrustAnchor().Digest))
+				parentKeys := collectDNSKEYs(query(handler, "com", dns.TypeDNSKEY))
+				verifyRRSIG(t, parentKeys[1], collectRRSIGs(resp.Answer)[0], resp.Answer)
+			},
+		},
+
+		{
+			name:  "DNSSECFaultAlgorithmDowngrade",
+			fault: DNSSECFaultAlgorithmDowngrade,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				resp := query(handler, "example.com", dns.TypeDNSKEY)
+				keys := collectDNSKEYs(resp)
+				assert.Len(t, keys, 3)
+				assert.Equal(t, dns.RSASHA1, keys[2].Algorithm)
+				sigs := collectRRSIGs(resp.Answer)
+				assert.Len(t, sigs, 1)
+				assert.Equal(t, dns.RSASHA1, sigs[0].Algorithm)
+				verifyRRSIG(t, keys[2], sigs[0], resp.Answer)
+				assert.Error(t, sigs[0].Verify(child.KSK(), resp.Answer[:3]))
+				assert.Equal(t, dns.ECDSAP256SHA256, child.TrustAnchor().Algorithm)
+				resp = query(handler, "www.example.com", dns.TypeA)
+				sigs = collectRRSIGs(resp.Answer)
+				assert.Len(t, sigs, 1)
+				assert.Equal(t, dns.RSASHA1, sigs[0].Algorithm)
+				verifyRRSIG(t, keys[2], sigs[0], resp.Answer)
+				assert.Error(t, validateChain(handler, child.TrustAnchor(), "www.example.com", dns.TypeA))
+			},
+		},
+
+		{
+			name:  "DNSSECFaultStrippedSignatures",
+			fault: DNSSECFaultStrippedSignatures,
+			validate: func(t *testing.T, handler *Handler, parent, child *SignedZone) {
+				assert.Empty(t, collectRRSIGs(query(handler, "example.com", dns.TypeDNSKEY).Answer))
+				resp := query(handler, "www.example.com", dns.TypeA)
+				assert.Len(t, resp.Answer, 1)
+				assert.Empty(t, collectRRSIGs(resp.Answer))
+				resp = query(handler, "nonexistent.example.com", dns.TypeA)
+				assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+				assert.Empty(t, collectRRSIGs(resp.Ns))
+				// the parent still signs the DS
+				assert.Len(t, collectRRSIGs(query(handler, "example.com", dns.TypeDS).Answer), 1)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewHandlerConfig()
+			parent := config.SignZone("com")
+			child := config.SignZone("example.com")
+			config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+			child.SetFault(tc.fault)
+			assert.Equal(t, tc.fault, child.Fault())
+			tc.validate(t, NewHandler(config), parent, child)
+		})
+	}
+}
+
+func TestSignedZoneSetFaultUnknown(t *testing.T) {
+	assert.Panics(t, func() {
+		NewHandlerConfig().SignZone("example.com").SetFault(DNSSECFault(-1))
+	})
+}
@@ -0,0 +1,490 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// Document is a declarative description of a [*HandlerConfig] and of
+// the servers using it, which allows to drive tests using data files.
+//
+// Construct using [ParseDocument] or manually. A minimal YAML document
+// looks like the following:
+//
+//	records:
+//	  - name: www.example.com
+//	    type: A
+//	    value: 104.20.34.220
+//	zones:
+//	  - name: example.com
+//	    fault: expired-signatures
+//	servers:
+//	  - protocol: udp
+//	  - protocol: https
+//	    address: 127.0.0.1:8443
+type Document struct {
+	// AutoPTR enables [*HandlerConfig.SetAutoPTR].
+	AutoPTR bool `yaml:"autoPTR"`
+
+	// DNS64Prefix is the OPTIONAL prefix for [*HandlerConfig.SetDNS64Prefix].
+	DNS64Prefix string `yaml:"dns64Prefix"`
+
+	// Records contains the records to add.
+	Records []DocumentRecord `yaml:"records"`
+
+	// Servers contains the servers to start.
+	Servers []DocumentServer `yaml:"servers"`
+
+	// Zones contains the zones to sign.
+	Zones []DocumentZone `yaml:"zones"`
+}
+
+// DocumentRecord is a record within a [Document].
+type DocumentRecord struct {
+	// Name is the MANDATORY owner name.
+	Name string `yaml:"name"`
+
+	// Subnet is the OPTIONAL client subnet of A and AAAA records,
+	// which causes us to use [*HandlerConfig.AddSubnetNetipAddr].
+	Subnet string `yaml:"subnet"`
+
+	// Type is the MANDATORY record type: A, AAAA, or CNAME.
+	Type string `yaml:"type"`
+
+	// Value is the MANDATORY address or CNAME target.
+	Value string `yaml:"value"`
+}
+
+// DocumentZone is a signed zone within a [Document].
+type DocumentZone struct {
+	// Fault is the OPTIONAL [DNSSECFault] using kebab case names
+	// such as "none", "expired-signatures", or "ds-mismatch".
+	Fault string `yaml:"fault"`
+
+	// Name is the MANDATORY zone name.
+	Name string `yaml:"name"`
+
+	// NSEC3 contains the OPTIONAL NSEC3 parameters, which causes us
+	// to use [*HandlerConfig.SignZoneWithNSEC3].
+	NSEC3 *DocumentNSEC3 `yaml:"nsec3"`
+}
+
+// DocumentNSEC3 describes the [NSEC3Params] of a [DocumentZone].
+type DocumentNSEC3 struct {
+	// Iterations is the number of additional hash iterations.
+	Iterations uint16 `yaml:"iterations"`
+
+	// OptOut sets the opt-out flag of the NSEC3 records.
+	OptOut bool `yaml:"optOut"`
+
+	// Salt is the hex-encoded salt or empty for no salt.
+	Salt string `yaml:"salt"`
+}
+
+// DocumentServer is a server within a [Document].
+type DocumentServer struct {
+	// Address is the OPTIONAL address to listen on, which
+	// defaults to [DocumentDefaultAddress].
+	Address string `yaml:"address"`
+
+	// HandshakeFault is the OPTIONAL [TLSHandshakeFault] of TLS and HTTPS
+	// servers using names such as "none", "stall", "alert", or "reset".
+	HandshakeFault string `yaml:"handshakeFault"`
+
+	// HTTPSFault is the OPTIONAL [HTTPSFault] of HTTPS servers.
+	HTTPSFault *DocumentHTTPSFault `yaml:"httpsFault"`
+
+	// Protocol is the MANDATORY protocol: udp, tcp, tls, or https.
+	Protocol string `yaml:"protocol"`
+}
+
+// DocumentHTTPSFault describes an [HTTPSFault] within a [DocumentServer].
+//
+// Exactly one of the fields, except RetryAfter, must be set.
+type DocumentHTTPSFault struct {
+	// CloseAfterHeaders selects [HTTPSFaultCloseAfterHeaders].
+	CloseAfterHeaders bool `yaml:"closeAfterHeaders"`
+
+	// ContentType selects [HTTPSFaultContentType].
+	ContentType string `yaml:"contentType"`
+
+	// GoAway selects [HTTPSFaultGoAway].
+	GoAway bool `yaml:"goAway"`
+
+	// Redirect selects [HTTPSFaultRedirect].
+	Redirect int `yaml:"redirect"`
+
+	// RetryAfter is the OPTIONAL Retry-After header used along with Status.
+	RetryAfter string `yaml:"retryAfter"`
+
+	// StallBody selects [HTTPSFaultStallBody] (e.g., "5s").
+	StallBody time.Duration `yaml:"stallBody"`
+
+	// Status selects [HTTPSFaultStatus] and MUST be within 100 and 599.
+	Status int `yaml:"status"`
+}
+
+// DocumentDefaultAddress is the default [DocumentServer] address.
+const DocumentDefaultAddress = "127.0.0.1:0"
+
+// documentDNSSECFaults maps the names used by documents to [DNSSECFault].
+var documentDNSSECFaults = map[string]DNSSECFault{
+	"":                    DNSSECFaultNone,
+	"none":                DNSSECFaultNone,
+	"expired-signatures":  DNSSECFaultExpiredSignatures,
+	"unknown-key":         DNSSECFaultUnknownKey,
+	"missing-dnskey":      DNSSECFaultMissingDNSKEY,
+	"ds-mismatch":         DNSSECFaultDSMismatch,
+	"algorithm-downgrade": DNSSECFaultAlgorithmDowngrade,
+	"stripped-signatures": DNSSECFaultStrippedSignatures,
+}
+
+// documentHandshakeFaults maps the names used by documents to [TLSHandshakeFault].
+var documentHandshakeFaults = map[string]TLSHandshakeFault{
+	"":      TLSHandshakeFaultNone,
+	"none":  TLSHandshakeFaultNone,
+	"stall": TLSHandshakeFaultStall,
+	"alert": TLSHandshakeFaultAlert,
+	"reset": TLSHandshakeFaultReset,
+}
+
+// ParseDocument parses and validates a YAML or JSON [Document].
+//
+// On failure, the error mentions the line number of the offending
+// field, when known. Unknown fields are errors.
+func ParseDocument(data []byte) (*Document, error) {
+	// 1. decode the document rejecting unknown fields
+	doc := &Document{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("dnstest: document: %w", err)
+	}
+
+	// 2. decode the nodes again to know the line numbers
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(data, root); err != nil {
+		return nil, fmt.Errorf("dnstest: document: %w", err)
+	}
+
+	// 3. validate the document
+	if err := doc.validate(root); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// MustNewHandlerConfig returns a new [*HandlerConfig] containing the
+// records, zones, and options described by the [Document].
+//
+// This method PANICS if the document is invalid.
+func (d *Document) MustNewHandlerConfig() *HandlerConfig {
+	runtimex.PanicOnError0(d.validate(nil))
+
+	// 1. configure the options affecting how we add records
+	config := NewHandlerConfig()
+	config.SetAutoPTR(d.AutoPTR)
+	if d.DNS64Prefix != "" {
+		config.SetDNS64Prefix(netip.MustParsePrefix(d.DNS64Prefix))
+	}
+
+	// 2. add the records
+	for _, record := range d.Records {
+		switch strings.ToUpper(record.Type) {
+		case "CNAME":
+			config.AddCNAME(record.Name, record.Value)
+		default:
+			addr := netip.MustParseAddr(record.Value)
+			if record.Subnet == "" {
+				config.AddNetipAddr(record.Name, addr)
+				continue
+			}
+			config.AddSubnetNetipAddr(record.Name, netip.MustParsePrefix(record.Subnet), addr)
+		}
+	}
+
+	// 3. sign the zones
+	for _, zone := range d.Zones {
+		var sz *SignedZone
+		switch zone.NSEC3 {
+		case nil:
+			sz = config.SignZone(zone.Name)
+		default:
+			sz = config.SignZoneWithNSEC3(zone.Name, &NSEC3Params{
+				Iterations: zone.NSEC3.Iterations,
+				OptOut:     zone.NSEC3.OptOut,
+				Salt:       zone.NSEC3.Salt,
+			})
+		}
+		sz.SetFault(documentDNSSECFaults[strings.ToLower(zone.Fault)])
+	}
+	return config
+}
+
+// DocumentListenConfig is the [*net.ListenConfig] used by [*Document.MustNewServers].
+type DocumentListenConfig interface {
+	UDPListenConfig
+	TCPListenConfig
+}
+
+// Ensure that [*net.ListenConfig] implements [DocumentListenConfig].
+var _ DocumentListenConfig = &net.ListenConfig{}
+
+// DocumentServers contains the servers started by [*Document.MustNewServers]
+// in the same order of the [Document].
+type DocumentServers struct {
+	// HTTPS contains the DNS-over-HTTPS servers.
+	HTTPS []*HTTPSServer
+
+	// TCP contains the DNS-over-TCP servers.
+	TCP []*TCPServer
+
+	// TLS contains the DNS-over-TLS servers.
+	TLS []*TLSServer
+
+	// UDP contains the DNS-over-UDP servers.
+	UDP []*UDPServer
+}
+
+// MustNewServers starts the servers described by the [Document] using
+// the given handler, e.g., one using [*Document.MustNewHandlerConfig].
+//
+// The cert is only used by the DNS-over-TLS and DNS-over-HTTPS servers.
+//
+// This method PANICS if the document is invalid or on failure.
+func (d *Document) MustNewServers(lc DocumentListenConfig, cert tls.Certificate, handler dns.Handler) *DocumentServers {
+	runtimex.PanicOnError0(d.validate(nil))
+
+	servers := &DocumentServers{}
+	for _, entry := range d.Servers {
+		address := entry.Address
+		if address == "" {
+			address = DocumentDefaultAddress
+		}
+		switch strings.ToLower(entry.Protocol) {
+		case "udp":
+			servers.UDP = append(servers.UDP, MustNewUDPServer(lc, address, handler))
+
+		case "tcp":
+			servers.TCP = append(servers.TCP, MustNewTCPServer(lc, address, handler))
+
+		case "tls":
+			srv := MustNewTLSServer(lc, address, cert, handler)
+			srv.SetHandshakeFault(documentHandshakeFaults[strings.ToLower(entry.HandshakeFault)])
+			servers.TLS = append(servers.TLS, srv)
+
+		default:
+			srv := MustNewHTTPSServer(lc, address, cert, handler)
+			srv.SetHandshakeFault(documentHandshakeFaults[strings.ToLower(entry.HandshakeFault)])
+			if entry.HTTPSFault != nil {
+				srv.SetFault(entry.HTTPSFault.fault())
+			}
+			servers.HTTPS = append(servers.HTTPS, srv)
+		}
+	}
+	return servers
+}
+
+// Close closes all the servers.
+func (ds *DocumentServers) Close() {
+	for _, srv := range ds.UDP {
+		srv.Close()
+	}
+	for _, srv := range ds.TCP {
+		srv.Close()
+	}
+	for _, srv := range ds.TLS {
+		srv.Close()
+	}
+	for _, srv := range ds.HTTPS {
+		srv.Close()
+	}
+}
+
+// fault returns the corresponding [HTTPSFault].
+func (f *DocumentHTTPSFault) fault() HTTPSFault {
+	switch {
+	case f.CloseAfterHeaders:
+		return HTTPSFaultCloseAfterHeaders()
+	case f.ContentType != "":
+		return HTTPSFaultContentType(f.ContentType)
+	case f.GoAway:
+		return HTTPSFaultGoAway()
+	case f.Redirect > 0:
+		return HTTPSFaultRedirect(f.Redirect)
+	case f.StallBody > 0:
+		return HTTPSFaultStallBody(f.StallBody)
+	default:
+		return HTTPSFaultStatus(f.Status, f.RetryAfter)
+	}
+}
+
+// count returns the number of selected faults.
+func (f *DocumentHTTPSFault) count() (count int) {
+	for _, selected := range []bool{f.CloseAfterHeaders, f.ContentType != "",
+		f.GoAway, f.Redirect > 0, f.StallBody > 0, f.Status > 0} {
+		if selected {
+			count++
+		}
+	}
+	return
+}
+
+// validate returns an error when the [Document] is invalid, using the
+// root node, which may be nil, to figure out the line numbers.
+func (d *Document) validate(root *yaml.Node) error {
+	// errorf returns an error for the field at the given path.
+	errorf := func(path []any, format string, args ...any) error {
+		var field strings.Builder
+		for _, elem := range path {
+			switch elem := elem.(type) {
+			case int:
+				fmt.Fprintf(&field, "[%d]", elem)
+			default:
+				if field.Len() > 0 {
+					field.WriteString(".")
+				}
+				fmt.Fprint(&field, elem)
+			}
+		}
+		message := fmt.Sprintf(format, args...)
+		if line := documentNodeLine(root, path...); line > 0 {
+			return fmt.Errorf("dnstest: document line %d: %s: %s", line, field.String(), message)
+		}
+		return fmt.Errorf("dnstest: document: %s: %s", field.String(), message)
+	}
+
+	// 1. validate the options
+	if d.DNS64Prefix != "" {
+		if prefix, err := netip.ParsePrefix(d.DNS64Prefix); err != nil || !validDNS64Prefix(prefix) {
+			return errorf([]any{"dns64Prefix"}, "invalid NAT64 prefix %q", d.DNS64Prefix)
+		}
+	}
+
+	// 2. validate the records
+	for idx, record := range d.Records {
+		if _, ok := dns.IsDomainName(record.Name); !ok || record.Name == "" {
+			return errorf([]any{"records", idx, "name"}, "invalid name %q", record.Name)
+		}
+		switch rrtype := strings.ToUpper(record.Type); rrtype {
+		case "A", "AAAA":
+			addr, err := netip.ParseAddr(record.Value)
+			if err != nil || addr.Zone() != "" || (rrtype == "A") != addr.Is4() {
+				return errorf([]any{"records", idx, "value"}, "invalid %s address %q", rrtype, record.Value)
+			}
+			if record.Subnet != "" {
+				if _, err := netip.ParsePrefix(record.Subnet); err != nil {
+					return errorf([]any{"records", idx, "subnet"}, "invalid subnet %q", record.Subnet)
+				}
+			}
+
+		case "CNAME":
+			if _, ok := dns.IsDomainName(record.Value); !ok || record.Value == "" {
+				return errorf([]any{"records", idx, "value"}, "invalid CNAME target %q", record.Value)
+			}
+			if record.Subnet != "" {
+				return errorf([]any{"records", idx, "subnet"}, "subnet requires A or AAAA records")
+			}
+
+		default:
+			return errorf([]any{"records", idx, "type"}, "unsupported record type %q", record.Type)
+		}
+	}
+
+	// 3. validate the zones
+	for idx, zone := range d.Zones {
+		if _, ok := dns.IsDomainName(zone.Name); !ok || zone.Name == "" {
+			return errorf([]any{"zones", idx, "name"}, "invalid name %q", zone.Name)
+		}
+		if _, found := documentDNSSECFaults[strings.ToLower(zone.Fault)]; !found {
+			return errorf([]any{"zones", idx, "fault"}, "unknown DNSSEC fault %q", zone.Fault)
+		}
+		if zone.NSEC3 != nil {
+			if salt, err := hex.DecodeString(zone.NSEC3.Salt); err != nil || len(salt) > 255 {
+				return errorf([]any{"zones", idx, "nsec3", "salt"}, "invalid salt %q", zone.NSEC3.Salt)
+			}
+		}
+	}
+
+	// 4. validate the servers
+	for idx, server := range d.Servers {
+		protocol := strings.ToLower(server.Protocol)
+		switch protocol {
+		case "udp", "tcp", "tls", "https":
+		default:
+			return errorf([]any{"servers", idx, "protocol"}, "unsupported protocol %q", server.Protocol)
+		}
+		if server.Address != "" {
+			if _, _, err := net.SplitHostPort(server.Address); err != nil {
+				return errorf([]any{"servers", idx, "address"}, "invalid address %q", server.Address)
+			}
+		}
+		if _, found := documentHandshakeFaults[strings.ToLower(server.HandshakeFault)]; !found {
+			return errorf([]any{"servers", idx, "handshakeFault"}, "unknown handshake fault %q", server.HandshakeFault)
+		}
+		if server.HandshakeFault != "" && protocol != "tls" && protocol != "https" {
+			return errorf([]any{"servers", idx, "handshakeFault"}, "requires the tls or https protocol")
+		}
+		if server.HTTPSFault != nil {
+			if protocol != "https" {
+				return errorf([]any{"servers", idx, "httpsFault"}, "requires the https protocol")
+			}
+			if status := server.HTTPSFault.Status; status != 0 && (status < 100 || status > 599) {
+				return errorf([]any{"servers", idx, "httpsFault", "status"}, "invalid HTTP status %d", status)
+			}
+			if server.HTTPSFault.count() != 1 {
+				return errorf([]any{"servers", idx, "httpsFault"}, "must select exactly one fault")
+			}
+			if server.HTTPSFault.RetryAfter != "" && server.HTTPSFault.Status <= 0 {
+				return errorf([]any{"servers", idx, "httpsFault", "retryAfter"}, "requires status")
+			}
+		}
+	}
+	return nil
+}
+
+// documentNodeLine returns the line of the node at the given path, where each
+// element is either a mapping key or a sequence index, falling back to the line
+// of the deepest existing node, or zero when the root node is nil.
+func documentNodeLine(node *yaml.Node, path ...any) int {
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, elem := range path {
+		var next *yaml.Node
+		switch elem := elem.(type) {
+		case int:
+			if node.Kind == yaml.SequenceNode && elem < len(node.Content) {
+				next = node.Content[elem]
+			}
+		case string:
+			for idx := 0; node.Kind == yaml.MappingNode && idx+1 < len(node.Content); idx += 2 {
+				if node.Content[idx].Value == elem {
+					next = node.Content[idx+1]
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
@@ -0,0 +1,304 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// documentTestYAML is the YAML document used by the tests.
+const documentTestYAML = `# records
+autoPTR: true
+dns64Prefix: 64:ff9b::/96
+records:
+  - name: www.example.com
+    type: A
+    value: 104.20.34.220
+  - name: www.example.com
+    type: A
+    value: 192.0.2.1
+    subnet: 198.51.100.0/24
+  - name: alias.example.com
+    type: CNAME
+    value: www.example.com
+  - name: www.example.org
+    type: aaaa
+    value: 2001:db8::1
+zones:
+  - name: example.com
+    fault: Expired-Signatures
+  - name: example.org
+    nsec3:
+      iterations: 1
+      optOut: true
+      salt: aabbccdd
+servers:
+  - protocol: udp
+  - protocol: tcp
+  - protocol: tls
+    handshakeFault: RESET
+  - protocol: https
+    address: 127.0.0.1:0
+    httpsFault:
+      status: 503
+      retryAfter: "5"
+`
+
+// documentTestJSON is the JSON equivalent of a subset of [documentTestYAML].
+const documentTestJSON = `{
+	"records": [
+		{"name": "www.example.com", "type": "A", "value": "104.20.34.220"},
+		{"name": "alias.example.com", "type": "CNAME", "value": "www.example.com"}
+	],
+	"zones": [{"name": "example.com", "fault": "expired-signatures"}],
+	"servers": [{"protocol": "udp"}]
+}`
+
+func TestParseDocument(t *testing.T) {
+	t.Run("YAML", func(t *testing.T) {
+		doc, err := ParseDocument([]byte(documentTestYAML))
+		assert.NoError(t, err)
+		assert.Len(t, doc.Records, 4)
+		assert.Equal(t, &DocumentNSEC3{Iterations: 1, OptOut: true, Salt: "aabbccdd"}, doc.Zones[1].NSEC3)
+		assert.Equal(t, &DocumentHTTPSFault{Status: 503, RetryAfter: "5"}, doc.Servers[3].HTTPSFault)
+
+		// make sure we can build a working config
+		config := doc.MustNewHandlerConfig()
+		handler := NewHandler(config)
+		assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(handler.PrepareResponse(
+			newDNSSECTestQuery("alias.example.com", dns.TypeA, false))))
+		assert.Equal(t, []string{"64:ff9b::6814:22dc"}, collectAddrs(handler.PrepareResponse(
+			newDNSSECTestQuery("www.example.com", dns.TypeAAAA, false))))
+		assert.Equal(t, []string{"www.example.org."},
+			config.LookupAddr(netip.MustParseAddr("2001:db8::1")))
+		assert.Equal(t, DNSSECFaultExpiredSignatures, config.findZone("example.com", dns.TypeA).Fault())
+		assert.NotNil(t, config.findZone("example.org", dns.TypeA).nsec3)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		doc, err := ParseDocument([]byte(documentTestJSON))
+		assert.NoError(t, err)
+		assert.Equal(t, &Document{
+			Records: []DocumentRecord{
+				{Name: "www.example.com", Type: "A", Value: "104.20.34.220"},
+				{Name: "alias.example.com", Type: "CNAME", Value: "www.example.com"},
+			},
+			Zones:   []DocumentZone{{Name: "example.com", Fault: "expired-signatures"}},
+			Servers: []DocumentServer{{Protocol: "udp"}},
+		}, doc)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		doc, err := ParseDocument(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, &Document{}, doc)
+	})
+}
+
+func TestParseDocumentErrors(t *testing.T) {
+	type testCase struct {
+		name      string
+		content   string
+		expectErr string
+	}
+
+	testCases := []testCase{
+		{
+			name:      "syntax error",
+			content:   "records:\n  - name: [\n",
+			expectErr: "dnstest: document: yaml: line 2: did not find expected node content",
+		},
+
+		{
+			name:      "unknown field",
+			content:   "records:\n  - name: www.example.com\n    typo: A\n",
+			expectErr: "dnstest: document: yaml: unmarshal errors:\n  line 3: field typo not found in type dnstest.DocumentRecord",
+		},
+
+		{
+			name:      "wrong type",
+			content:   "autoPTR: [1, 2]\n",
+			expectErr: "dnstest: document: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!seq into bool",
+		},
+
+		{
+			name:      "invalid DNS64 prefix",
+			content:   "dns64Prefix: 10.0.0.0/8\n",
+			expectErr: `dnstest: document line 1: dns64Prefix: invalid NAT64 prefix "10.0.0.0/8"`,
+		},
+
+		{
+			name:      "invalid record name",
+			content:   "records:\n  - type: A\n    value: 192.0.2.1\n",
+			expectErr: `dnstest: document line 2: records[0].name: invalid name ""`,
+		},
+
+		{
+			name:      "invalid record address",
+			content:   "records:\n  - name: a.example\n    type: A\n    value: 192.0.2.1\n  - name: b.example\n    type: A\n    value: 2001:db8::1\n",
+			expectErr: `dnstest: document line 7: records[1].value: invalid A address "2001:db8::1"`,
+		},
+
+		{
+			name:      "invalid record subnet",
+			content:   "records:\n  - name: a.example\n    type: A\n    value: 192.0.2.1\n    subnet: 198.51.100.0\n",
+			expectErr: `dnstest: document line 5: records[0].subnet: invalid subnet "198.51.100.0"`,
+		},
+
+		{
+			name:      "CNAME with subnet",
+			content:   "records:\n  - name: a.example\n    type: CNAME\n    value: b.example\n    subnet: 198.51.100.0/24\n",
+			expectErr: `dnstest: document line 5: records[0].subnet: subnet requires A or AAAA records`,
+		},
+
+		{
+			name:      "unsupported record type",
+			content:   "records:\n  - name: a.example\n    type: MX\n    value: b.example\n",
+			expectErr: `dnstest: document line 3: records[0].type: unsupported record type "MX"`,
+		},
+
+		{
+			name:      "unknown DNSSEC fault",
+			content:   "zones:\n  - name: example.com\n    fault: broken\n",
+			expectErr: `dnstest: document line 3: zones[0].fault: unknown DNSSEC fault "broken"`,
+		},
+
+		{
+			name:      "invalid salt",
+			content:   "zones:\n  - name: example.com\n    nsec3:\n      salt: xyz\n",
+			expectErr: `dnstest: document line 4: zones[0].nsec3.salt: invalid salt "xyz"`,
+		},
+
+		{
+			name:      "unsupported protocol",
+			content:   "servers:\n  - protocol: quic\n",
+			expectErr: `dnstest: document line 2: servers[0].protocol: unsupported protocol "quic"`,
+		},
+
+		{
+			name:      "invalid server address",
+			content:   "servers:\n  - protocol: udp\n    address: 127.0.0.1\n",
+			expectErr: `dnstest: document line 3: servers[0].address: invalid address "127.0.0.1"`,
+		},
+
+		{
+			name:      "handshake fault with UDP",
+			content:   "servers:\n  - protocol: udp\n    handshakeFault: stall\n",
+			expectErr: `dnstest: document line 3: servers[0].handshakeFault: requires the tls or https protocol`,
+		},
+
+		{
+			name:      "unknown handshake fault",
+			content:   "servers:\n  - protocol: tls\n    handshakeFault: slow\n",
+			expectErr: `dnstest: document line 3: servers[0].handshakeFault: unknown handshake fault "slow"`,
+		},
+
+		{
+			name:      "HTTPS fault with TLS",
+			content:   "servers:\n  - protocol: tls\n    httpsFault:\n      goAway: true\n",
+			expectErr: `dnstest: document line 4: servers[0].httpsFault: requires the https protocol`,
+		},
+
+		{
+			name:      "multiple HTTPS faults",
+			content:   "servers:\n  - protocol: https\n    httpsFault:\n      goAway: true\n      status: 503\n",
+			expectErr: `dnstest: document line 4: servers[0].httpsFault: must select exactly one fault`,
+		},
+
+		{
+			name:      "HTTP status too small",
+			content:   "servers:\n  - protocol: https\n    httpsFault:\n      status: 99\n",
+			expectErr: `dnstest: document line 4: servers[0].httpsFault.status: invalid HTTP status 99`,
+		},
+
+		{
+			name:      "HTTP status too large",
+			content:   "servers:\n  - protocol: https\n    httpsFault:\n      status: 600\n",
+			expectErr: `dnstest: document line 4: servers[0].httpsFault.status: invalid HTTP status 600`,
+		},
+
+		{
+			name:      "retry after without status",
+			content:   "servers:\n  - protocol: https\n    httpsFault:\n      goAway: true\n      retryAfter: \"5\"\n",
+			expectErr: `dnstest: document line 5: servers[0].httpsFault.retryAfter: requires status`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := ParseDocument([]byte(tc.content))
+			assert.Nil(t, doc)
+			assert.EqualError(t, err, tc.expectErr)
+		})
+	}
+}
+
+func TestDocumentMustNewServers(t *testing.T) {
+	// parse the document and create the handler
+	doc, err := ParseDocument([]byte(documentTestYAML))
+	assert.NoError(t, err)
+	handler := NewHandler(doc.MustNewHandlerConfig())
+
+	// create the servers
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		IPAddrs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Organization: []string{"Example"},
+	})
+	servers := doc.MustNewServers(&net.ListenConfig{}, cert, handler)
+	defer servers.Close()
+	assert.Len(t, servers.UDP, 1)
+	assert.Len(t, servers.TCP, 1)
+	assert.Len(t, servers.TLS, 1)
+	assert.Len(t, servers.HTTPS, 1)
+
+	// query the plaintext servers
+	query := newDNSSECTestQuery("www.example.com", dns.TypeA, false)
+	for _, network := range []string{"udp", "tcp"} {
+		address := servers.UDP[0].Address()
+		if network == "tcp" {
+			address = servers.TCP[0].Address()
+		}
+		resp, _, err := (&dns.Client{Net: network}).Exchange(query, address)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	}
+
+	// make sure the TLS server resets the connection
+	dialer := &tls.Dialer{Config: &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}}
+	conn, err := dialer.Dial("tcp", servers.TLS[0].Address())
+	assert.Error(t, err)
+	assert.Nil(t, conn)
+
+	// make sure the HTTPS server replies with 503
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pki.CertPool()}},
+	}
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(servers.HTTPS[0].URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, httpResp.StatusCode)
+	assert.Equal(t, "5", httpResp.Header.Get("Retry-After"))
+}
+
+func TestDocumentMustPanicsWhenInvalid(t *testing.T) {
+	doc := &Document{Records: []DocumentRecord{{Name: "www.example.com", Type: "MX"}}}
+	assert.PanicsWithError(t, `dnstest: document: records[0].type: unsupported record type "MX"`, func() {
+		doc.MustNewHandlerConfig()
+	})
+	assert.Panics(t, func() {
+		doc.MustNewServers(&net.ListenConfig{}, tls.Certificate{}, NewHandler(NewHandlerConfig()))
+	})
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+
+	"github.com/bassosimone/runtimex"
+)
+
+// ECHConfig contains an Encrypted Client Hello (ECH) configuration.
+//
+// Construct using [MustNewECHConfig].
+type ECHConfig struct {
+	// ConfigList is the ECHConfigList to publish to clients using, e.g.,
+	// [*HandlerConfig.AddECHConfigList] or tls.Config.EncryptedClientHelloConfigList.
+	ConfigList []byte
+
+	// Key is the key to use on the server side.
+	Key tls.EncryptedClientHelloKey
+}
+
+// ECH wire format constants (see draft-ietf-tls-esni and RFC 9180).
+const (
+	echConfigVersion   = 0xfe0d
+	echKEMX25519SHA256 = 0x0020
+	echKDFHKDFSHA256   = 0x0001
+	echAEADAES128GCM   = 0x0001
+	echMaxNameLength   = 64
+)
+
+// MustNewECHConfig generates a new [*ECHConfig] using a fresh X25519 key,
+// HKDF-SHA256, AES-128-GCM, and the given public name, which is the SNI
+// clients use in the outer ClientHello.
+//
+// The server certificate MUST also be valid for the public name, otherwise
+// clients cannot authenticate the server when it rejects ECH.
+//
+// This function PANICS on failure.
+func MustNewECHConfig(publicName string) *ECHConfig {
+	runtimex.Assert(len(publicName) >= 1 && len(publicName) <= 255)
+	privateKey := runtimex.PanicOnError1(ecdh.X25519().GenerateKey(rand.Reader))
+	publicKey := privateKey.PublicKey().Bytes()
+	configID := make([]byte, 1)
+	runtimex.PanicOnError1(rand.Read(configID))
+
+	// serialize ECHConfigContents
+	var contents []byte
+	contents = append(contents, configID[0])
+	contents = binary.BigEndian.AppendUint16(contents, echKEMX25519SHA256)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(publicKey)))
+	contents = append(contents, publicKey...)
+	contents = binary.BigEndian.AppendUint16(contents, 4) // cipher suites length
+	contents = binary.BigEndian.AppendUint16(contents, echKDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, echAEADAES128GCM)
+	contents = append(contents, echMaxNameLength)
+	contents = append(contents, uint8(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0) // no extensions
+
+	// serialize ECHConfig
+	var config []byte
+	config = binary.BigEndian.AppendUint16(config, echConfigVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+
+	// serialize ECHConfigList
+	var configList []byte
+	configList = binary.BigEndian.AppendUint16(configList, uint16(len(config)))
+	configList = append(configList, config...)
+
+	return &ECHConfig{
+		ConfigList: configList,
+		Key: tls.EncryptedClientHelloKey{
+			Config:      config,
+			PrivateKey:  privateKey.Bytes(),
+			SendAsRetry: true,
+		},
+	}
+}
+
+// TLSConfig returns a [*tls.Config] for [MustNewTLSServerWithConfig] and
+// [MustNewHTTPSServerWithConfig] using the given certificate and accepting
+// ECH using this configuration. Because ECH requires TLS 1.3, the config
+// sets MinVersion accordingly.
+func (ec *ECHConfig) TLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{ec.Key},
+		MinVersion:               tls.VersionTLS13,
+	}
+}
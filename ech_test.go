@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// lookupECHConfigListTest discovers the ECHConfigList of dns.example.com
+// by querying the HTTPS record using the given DNS-over-UDP server.
+func lookupECHConfigListTest(t *testing.T, address string) []byte {
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("dns.example.com"),
+		Qtype:  dns.TypeHTTPS,
+		Qclass: dns.ClassINET,
+	})
+	resp, err := dns.Exchange(query, address)
+	assert.NoError(t, err)
+	for _, rr := range resp.Answer {
+		if https, ok := rr.(*dns.HTTPS); ok {
+			for _, kv := range https.Value {
+				if ech, ok := kv.(*dns.SVCBECHConfig); ok {
+					return ech.ECH
+				}
+			}
+		}
+	}
+	t.Fatal("no ECHConfigList")
+	return nil
+}
+
+// newECHTestEnv creates the ECH config, a certificate valid for the public
+// and the private names, and a UDP server publishing the ECHConfigList.
+func newECHTestEnv() (*ECHConfig, tls.Certificate, *pkitest.PKI, *UDPServer) {
+	// create the ECH config
+	echConfig := MustNewECHConfig("public.example.com")
+
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com", "public.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create the DNS server used for discovery
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	config.AddNetipAddr("dns.example.com", netip.MustParseAddr("127.0.0.1"))
+	config.AddECHConfigList("dns.example.com", echConfig.ConfigList)
+	udpSrv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config))
+
+	return echConfig, cert, pki, udpSrv
+}
+
+func TestECHWithTLSServer(t *testing.T) {
+	echConfig, cert, pki, udpSrv := newECHTestEnv()
+	defer udpSrv.Close()
+
+	// create the DoT server
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	srv := MustNewTLSServerWithConfig(
+		&net.ListenConfig{}, "127.0.0.1:0", echConfig.TLSConfig(cert), NewHandler(config))
+	defer srv.Close()
+
+	// discover the ECHConfigList and connect using ECH
+	tlsCfg := &tls.Config{
+		EncryptedClientHelloConfigList: lookupECHConfigListTest(t, udpSrv.Address()),
+		RootCAs:                        pki.CertPool(),
+		ServerName:                     "dns.example.com",
+	}
+	conn, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.True(t, conn.ConnectionState().ECHAccepted)
+
+	// exchange
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	dconn := &dns.Conn{Conn: conn}
+	err = dconn.WriteMsg(query)
+	assert.NoError(t, err)
+	resp, err := dconn.ReadMsg()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+
+	// make sure the server saw the inner ClientHello
+	states := srv.ConnectionStates()
+	assert.Len(t, states, 1)
+	assert.True(t, states[0].ECHAccepted)
+	assert.Equal(t, "dns.example.com", states[0].ServerName)
+}
+
+func TestECHWithHTTPSServer(t *testing.T) {
+	echConfig, cert, pki, udpSrv := newECHTestEnv()
+	defer udpSrv.Close()
+
+	// create the DoH server
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	srv := MustNewHTTPSServerWithConfig(
+		&net.ListenConfig{}, "127.0.0.1:0", echConfig.TLSConfig(cert), NewHandler(config))
+	defer srv.Close()
+
+	// discover the ECHConfigList and connect using ECH
+	tlsCfg := &tls.Config{
+		EncryptedClientHelloConfigList: lookupECHConfigListTest(t, udpSrv.Address()),
+		RootCAs:                        pki.CertPool(),
+		ServerName:                     "dns.example.com",
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   tlsCfg,
+		ForceAttemptHTTP2: true,
+	}}
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.True(t, httpResp.TLS.ECHAccepted)
+}
+
+func TestECHRejectedWithStaleConfig(t *testing.T) {
+	echConfig, cert, pki, udpSrv := newECHTestEnv()
+	defer udpSrv.Close()
+
+	// create the DoT server
+	srv := MustNewTLSServerWithConfig(
+		&net.ListenConfig{}, "127.0.0.1:0", echConfig.TLSConfig(cert), NewHandler(NewHandlerConfig()))
+	defer srv.Close()
+
+	// connect using a stale config
+	staleConfig := MustNewECHConfig("public.example.com")
+	tlsCfg := &tls.Config{
+		EncryptedClientHelloConfigList: staleConfig.ConfigList,
+		RootCAs:                        pki.CertPool(),
+		ServerName:                     "dns.example.com",
+	}
+	_, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+
+	// make sure the server sent the retry configs
+	var echErr *tls.ECHRejectionError
+	assert.True(t, errors.As(err, &echErr))
+	assert.Equal(t, echConfig.ConfigList, echErr.RetryConfigList)
+}
+
+func TestMustNewECHConfigInvalidPublicName(t *testing.T) {
+	assert.Panics(t, func() {
+		MustNewECHConfig("")
+	})
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// subnetRR is a record only served to clients within a subnet.
+type subnetRR struct {
+	// rr is the record.
+	rr dns.RR
+
+	// subnet is the masked client subnet.
+	subnet netip.Prefix
+}
+
+// AddSubnetNetipAddr is like [*HandlerConfig.AddNetipAddr] but the handler only
+// returns the address to clients whose EDNS0 Client Subnet (ECS; see RFC 7871)
+// is within the given subnet, e.g., 203.0.113.0/24.
+//
+// When several subnets match, the handler uses the most specific subnet having
+// records of the query type, and echoes the ECS option using the subnet prefix
+// length as the scope prefix length. When no subnet matches or the query does
+// not include the ECS option, the handler uses the records added using
+// [*HandlerConfig.AddNetipAddr], and echoes the ECS option, if any, using zero
+// as the scope prefix length.
+//
+// A subnet only matches when its prefix length is less than or equal to the
+// source prefix length of the ECS option and the address families are equal.
+func (c *HandlerConfig) AddSubnetNetipAddr(name string, subnet netip.Prefix, addr netip.Addr) {
+	name = dns.CanonicalName(name)
+	record := subnetRR{rr: newNetipAddrRR(name, addr), subnet: subnet.Masked()}
+
+	c.mu.Lock()
+	c.addOwnerLocked(name)
+	c.subnets[name] = append(c.subnets[name], record)
+	c.maybeAddPTRLocked(addr, name)
+	c.mu.Unlock()
+}
+
+// queryECS returns the client subnet of the query ECS option, if any.
+func queryECS(query *dns.Msg) (netip.Prefix, bool) {
+	opt := query.IsEdns0()
+	if opt == nil {
+		return netip.Prefix{}, false
+	}
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			addr, ok := netip.AddrFromSlice(ecs.Address)
+			if !ok {
+				return netip.Prefix{}, false
+			}
+			if ecs.Family == 1 {
+				addr = addr.Unmap()
+			}
+			prefix, err := addr.Prefix(int(ecs.SourceNetmask))
+			return prefix, err == nil
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// lookupSubnet returns the records of the given name and type for the most
+// specific subnet matching the query ECS option, if any, along with the
+// prefix length of such a subnet.
+func (c *HandlerConfig) lookupSubnet(name string, qtype uint16, query *dns.Msg) ([]dns.RR, int) {
+	client, found := queryECS(query)
+	if !found {
+		return nil, 0
+	}
+	name = dns.CanonicalName(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 1. find the most specific subnet having records of the given type
+	best := -1
+	for _, entry := range c.subnets[name] {
+		if entry.rr.Header().Rrtype == qtype && entry.subnet.Addr().Is4() == client.Addr().Is4() &&
+			entry.subnet.Bits() <= client.Bits() && entry.subnet.Contains(client.Addr()) {
+			best = max(best, entry.subnet.Bits())
+		}
+	}
+
+	// 2. collect the records of such a subnet
+	var records []dns.RR
+	for _, entry := range c.subnets[name] {
+		if entry.rr.Header().Rrtype == qtype && entry.subnet.Bits() == best &&
+			entry.subnet.Addr().Is4() == client.Addr().Is4() && entry.subnet.Contains(client.Addr()) {
+			records = append(records, dns.Copy(entry.rr))
+		}
+	}
+	return records, max(best, 0)
+}
+
+// addECS adds to the OPT record of the response, which MUST exist, the ECS
+// option echoing the one of the query, if any, along with the scope prefix
+// length of the subnet used for the A and AAAA records in the answer.
+func (c *HandlerConfig) addECS(query, resp *dns.Msg) {
+	client, found := queryECS(query)
+	if !found {
+		return
+	}
+
+	// 1. compute the scope as the most specific subnet used for the answer
+	var scope int
+	for _, rr := range resp.Answer {
+		if rrtype := rr.Header().Rrtype; rrtype == dns.TypeA || rrtype == dns.TypeAAAA {
+			_, bits := c.lookupSubnet(rr.Header().Name, rrtype, query)
+			scope = max(scope, bits)
+		}
+	}
+
+	// 2. echo the option using the masked address
+	family := uint16(2)
+	if client.Addr().Is4() {
+		family = 1
+	}
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(client.Bits()),
+		SourceScope:   uint8(scope),
+		Address:       net.IP(client.Masked().Addr().AsSlice()),
+	})
+}
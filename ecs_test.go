@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newECSTestQuery creates a query for the given name and type using the given ECS option.
+func newECSTestQuery(name string, qtype uint16, ecs *dns.EDNS0_SUBNET) *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion(dns.CanonicalName(name), qtype)
+	query.SetEdns0(handlerEDNS0Size, false)
+	if ecs != nil {
+		opt := query.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+	return query
+}
+
+// newECSTestOption creates an ECS option for the given client subnet.
+func newECSTestOption(subnet string) *dns.EDNS0_SUBNET {
+	prefix := netip.MustParsePrefix(subnet)
+	family := uint16(2)
+	if prefix.Addr().Is4() {
+		family = 1
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+}
+
+// collectECS returns the ECS option within the OPT record, if any.
+func collectECS(resp *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+	}
+	return nil
+}
+
+func TestHandlerECS(t *testing.T) {
+	type testCase struct {
+		name        string
+		qname       string
+		qtype       uint16
+		ecs         *dns.EDNS0_SUBNET
+		expectRcode int
+		expectAddrs []string
+		expectScope int
+	}
+
+	// create config
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	config.AddSubnetNetipAddr("www.example.com", netip.MustParsePrefix("203.0.113.0/24"), netip.MustParseAddr("10.0.0.1"))
+	config.AddSubnetNetipAddr("www.example.com", netip.MustParsePrefix("203.0.113.128/25"), netip.MustParseAddr("10.0.0.2"))
+	config.AddSubnetNetipAddr("www.example.com", netip.MustParsePrefix("2001:db8::/32"), netip.MustParseAddr("10.0.0.3"))
+	config.AddSubnetNetipAddr("www.example.com", netip.MustParsePrefix("2001:db8::/32"), netip.MustParseAddr("2001:db8::1"))
+	config.AddSubnetNetipAddr("geo.example.com", netip.MustParsePrefix("198.51.100.0/24"), netip.MustParseAddr("10.0.0.4"))
+	config.AddCNAME("alias.example.com", "www.example.com")
+
+	testCases := []testCase{
+		{
+			name:        "without ECS we use the default records",
+			qname:       "www.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"104.20.34.220"},
+		},
+
+		{
+			name:        "ECS within the /24 subnet",
+			qname:       "www.example.com",
+			qtype:       dns.TypeA,
+			ecs:         newECSTestOption("203.0.113.0/24"),
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"10.0.0.1"},
+			expectScope: 24,
+		},
+
+		{
+			name:        "ECS within the more specific /25 subnet",
+			qname:       "www.example.com",
+			qtype:       dns.TypeA,
+			ecs:         newECSTestOption("203.0.113.200/32"),
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"10.0.0.2"},
+			expectScope: 25,
+		},
+
+		{
+			name:        "ECS shorter than the subnet",
+			qname:       "www.example.com",
+			qtype:       dns.TypeA,
+			ecs:         newECSTestOption("203.0.0.0/16"),
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"104.20.34.220"},
+		},
+
+		{
+			name:        "IPv6 ECS selecting IPv4 records",
+			qname:       "www.example.com",
+			qtype:       dns.TypeA,
+			ecs:         newECSTestOption("2001:db8:1::/48"),
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"10.0.0.3"},
+			expectScope: 32,
+		},
+
+		{
+			name:        "IPv6 ECS selecting IPv6 records",
+			qname:       "www.example.com",
+			qtype:       dns.TypeAAAA,
+			ecs:         newECSTestOption("2001:db8:1::/56"),
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"2001:db8::1"},
+			expectScope: 32,
+		},
+
+		{
+			name:        "ECS through a CNAME",
+			qname:       "alias.example.com",
+			qtype:       dns.TypeA,
+			ecs:         newECSTestOption("203.0.113.0/24"),
+			expectRcode: dns.RcodeSuccess,
+			expectAddrs: []string{"10.0.0.1"},
+			expectScope: 24,
+		},
+
+		{
+			name:        "name only existing for other subnets",
+			qname:       "geo.example.com",
+			qtype:       dns.TypeA,
+			ecs:         newECSTestOption("203.0.113.0/24"),
+			expectRcode: dns.RcodeSuccess,
+		},
+	}
+
+	// create server
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config.Clone()))
+	defer srv.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := dns.Exchange(newECSTestQuery(tc.qname, tc.qtype, tc.ecs), srv.Address())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectRcode, resp.Rcode)
+			assert.Equal(t, tc.expectAddrs, collectAddrs(resp))
+
+			ecs := collectECS(resp)
+			if tc.ecs == nil {
+				assert.Nil(t, ecs)
+				return
+			}
+			assert.NotNil(t, ecs)
+			assert.Equal(t, tc.ecs.Family, ecs.Family)
+			assert.Equal(t, tc.ecs.SourceNetmask, ecs.SourceNetmask)
+			assert.Equal(t, uint8(tc.expectScope), ecs.SourceScope)
+			assert.True(t, tc.ecs.Address.Equal(ecs.Address))
+		})
+	}
+}
+
+func TestHandlerConfigRemoveSubnets(t *testing.T) {
+	config := NewHandlerConfig()
+	config.AddSubnetNetipAddr("www.example.com", netip.MustParsePrefix("203.0.113.0/24"), netip.MustParseAddr("10.0.0.1"))
+	config.Remove("www.example.com")
+	resp := NewHandler(config).PrepareResponse(
+		newECSTestQuery("www.example.com", dns.TypeA, newECSTestOption("203.0.113.0/24")))
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
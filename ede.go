@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import "github.com/miekg/dns"
+
+// newEDE returns a new [*dns.EDNS0_EDE] option.
+func newEDE(code uint16, text string) *dns.EDNS0_EDE {
+	return &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+}
+
+// AddEDE attaches an Extended DNS Error (see RFC 8914) with the given info
+// code (e.g., [dns.ExtendedErrorCodeBlocked]) and extra text to the responses
+// for the given query name. Use an empty text to omit the extra text.
+//
+// The EDE option is carried by the OPT record, therefore the handler only
+// includes it when the query uses EDNS0. You can call this method multiple
+// times for the same name to attach multiple EDE options.
+func (c *HandlerConfig) AddEDE(name string, code uint16, text string) {
+	name = dns.CanonicalName(name)
+	c.mu.Lock()
+	c.ede[name] = append(c.ede[name], newEDE(code, text))
+	c.mu.Unlock()
+}
+
+// AddRcodeWideEDE is like [*HandlerConfig.AddEDE] but attaches the Extended
+// DNS Error to all the responses with the given rcode (e.g., [dns.RcodeServerFailure])
+// regardless of the query name. Note that this includes the ordinary responses
+// with such an rcode (e.g., the NXDOMAIN response for a name that does not
+// exist), so use [*HandlerConfig.AddEDE] to only target specific names.
+func (c *HandlerConfig) AddRcodeWideEDE(rcode int, code uint16, text string) {
+	c.mu.Lock()
+	c.rcodeEDE[rcode] = append(c.rcodeEDE[rcode], newEDE(code, text))
+	c.mu.Unlock()
+}
+
+// RemoveEDE removes the Extended DNS Errors attached to the given query name.
+func (c *HandlerConfig) RemoveEDE(name string) {
+	c.mu.Lock()
+	delete(c.ede, dns.CanonicalName(name))
+	c.mu.Unlock()
+}
+
+// addEDE adds to the OPT record of the response, which MUST exist, the
+// Extended DNS Errors attached to the query name and the response rcode.
+func (c *HandlerConfig) addEDE(query, resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(query.Question) == 1 {
+		for _, ede := range c.ede[dns.CanonicalName(query.Question[0].Name)] {
+			opt.Option = append(opt.Option, newEDE(ede.InfoCode, ede.ExtraText))
+		}
+	}
+	for _, ede := range c.rcodeEDE[resp.Rcode] {
+		opt.Option = append(opt.Option, newEDE(ede.InfoCode, ede.ExtraText))
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// collectEDE returns the Extended DNS Errors within the OPT record.
+func collectEDE(resp *dns.Msg) (output []dns.EDNS0_EDE) {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ede, ok := option.(*dns.EDNS0_EDE); ok {
+				output = append(output, *ede)
+			}
+		}
+	}
+	return
+}
+
+func TestHandlerEDE(t *testing.T) {
+	type testCase struct {
+		name        string
+		qname       string
+		edns0       bool
+		expectRcode int
+		expectEDE   []dns.EDNS0_EDE
+	}
+
+	// create config
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	config.AddEDE("www.example.com", dns.ExtendedErrorCodeStaleAnswer, "")
+	config.AddEDE("blocked.example.com", dns.ExtendedErrorCodeBlocked, "blocked by policy")
+	config.AddEDE("blocked.example.com", dns.ExtendedErrorCodeCensored, "")
+	config.AddEDE("removed.example.com", dns.ExtendedErrorCodeFiltered, "")
+	config.RemoveEDE("removed.example.com")
+	config.AddRcodeWideEDE(dns.RcodeNameError, dns.ExtendedErrorCodeNoReachableAuthority, "upstream unreachable")
+
+	testCases := []testCase{
+		{
+			name:        "EDE attached to an existing name",
+			qname:       "www.example.com",
+			edns0:       true,
+			expectRcode: dns.RcodeSuccess,
+			expectEDE: []dns.EDNS0_EDE{
+				{InfoCode: dns.ExtendedErrorCodeStaleAnswer},
+			},
+		},
+
+		{
+			name:        "EDE attached to the name and to the rcode",
+			qname:       "blocked.example.com",
+			edns0:       true,
+			expectRcode: dns.RcodeNameError,
+			expectEDE: []dns.EDNS0_EDE{
+				{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: "blocked by policy"},
+				{InfoCode: dns.ExtendedErrorCodeCensored},
+				{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "upstream unreachable"},
+			},
+		},
+
+		{
+			name:        "EDE attached to the rcode",
+			qname:       "removed.example.com",
+			edns0:       true,
+			expectRcode: dns.RcodeNameError,
+			expectEDE: []dns.EDNS0_EDE{
+				{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "upstream unreachable"},
+			},
+		},
+
+		{
+			name:        "no EDE without EDNS0",
+			qname:       "blocked.example.com",
+			edns0:       false,
+			expectRcode: dns.RcodeNameError,
+			expectEDE:   nil,
+		},
+	}
+
+	// create server
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config.Clone()))
+	defer srv.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := &dns.Msg{}
+			query.SetQuestion(dns.CanonicalName(tc.qname), dns.TypeA)
+			if tc.edns0 {
+				query.SetEdns0(handlerEDNS0Size, false)
+			}
+			resp, err := dns.Exchange(query, srv.Address())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectRcode, resp.Rcode)
+			assert.Equal(t, tc.edns0, resp.IsEdns0() != nil)
+			assert.Equal(t, tc.expectEDE, collectEDE(resp))
+		})
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/bassosimone/runtimex v0.0.0-20260615112505-ee72c4f0769e
 	github.com/miekg/dns v1.1.72
 	github.com/stretchr/testify v1.11.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -18,5 +19,4 @@ require (
 	golang.org/x/sync v0.21.0 // indirect
 	golang.org/x/sys v0.46.0 // indirect
 	golang.org/x/tools v0.46.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
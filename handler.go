@@ -7,7 +7,10 @@
 package dnstest
 
 import (
+	"iter"
 	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/miekg/dns"
@@ -17,27 +20,70 @@ import (
 //
 // Construct using [NewHandlerConfig].
 type HandlerConfig struct {
-	mu  sync.Mutex
-	rrs map[string][]dns.RR
+	autoPTR  bool
+	cookies  cookieConfig
+	dns64    netip.Prefix
+	ede      map[string][]*dns.EDNS0_EDE
+	flags    HeaderFlags
+	mu       sync.Mutex
+	names    map[string]int
+	orders   map[string]RecordOrder
+	rcodeEDE map[int][]*dns.EDNS0_EDE
+	rrs      map[string][]dns.RR
+	subnets  map[string][]subnetRR
+	views    []handlerView
+	zones    map[string]*SignedZone
 }
 
 // NewHandlerConfig constructs a [*HandlerConfig] instance.
 func NewHandlerConfig() *HandlerConfig {
 	return &HandlerConfig{
-		mu:  sync.Mutex{},
-		rrs: map[string][]dns.RR{},
+		ede:      map[string][]*dns.EDNS0_EDE{},
+		mu:       sync.Mutex{},
+		names:    map[string]int{},
+		orders:   map[string]RecordOrder{},
+		rcodeEDE: map[int][]*dns.EDNS0_EDE{},
+		rrs:      map[string][]dns.RR{},
+		subnets:  map[string][]subnetRR{},
+		zones:    map[string]*SignedZone{},
 	}
 }
 
 // Clone clones a [*HandlerConfig] instance.
+//
+// The clone shares with the original config the [*SignedZone] instances
+// and the view configs (see [*HandlerConfig.AddClientView]).
 func (c *HandlerConfig) Clone() *HandlerConfig {
 	c.mu.Lock()
 	out := NewHandlerConfig()
+	out.autoPTR = c.autoPTR
+	out.cookies = c.cookies
+	out.dns64 = c.dns64
+	out.flags = c.flags
+	out.views = slices.Clone(c.views)
 	for key, value := range c.rrs {
 		v := make([]dns.RR, 0, len(value))
 		v = append(v, value...)
 		out.rrs[key] = v
 	}
+	for key, value := range c.zones {
+		out.zones[key] = value
+	}
+	for key, value := range c.names {
+		out.names[key] = value
+	}
+	for key, value := range c.subnets {
+		out.subnets[key] = slices.Clone(value)
+	}
+	for key, value := range c.orders {
+		out.orders[key] = value
+	}
+	for key, value := range c.ede {
+		out.ede[key] = slices.Clone(value)
+	}
+	for key, value := range c.rcodeEDE {
+		out.rcodeEDE[key] = slices.Clone(value)
+	}
 	c.mu.Unlock()
 	return out
 }
@@ -48,11 +94,19 @@ const handlerDefaultTTL = 3600
 // AddNetipAddr adds a given [netip.Addr] to the [*HandlerConfig].
 func (c *HandlerConfig) AddNetipAddr(name string, addr netip.Addr) {
 	name = dns.CanonicalName(name)
+	record := newNetipAddrRR(name, addr)
+
+	c.mu.Lock()
+	c.addRRsLocked(name, record)
+	c.maybeAddPTRLocked(addr, name)
+	c.mu.Unlock()
+}
 
-	var record dns.RR
+// newNetipAddrRR returns the A or AAAA record for the given canonical name and [netip.Addr].
+func newNetipAddrRR(name string, addr netip.Addr) dns.RR {
 	switch addr.Is6() {
 	case true:
-		record = &dns.AAAA{
+		return &dns.AAAA{
 			Hdr: dns.RR_Header{
 				Name:   name,
 				Rrtype: dns.TypeAAAA,
@@ -63,7 +117,7 @@ func (c *HandlerConfig) AddNetipAddr(name string, addr netip.Addr) {
 		}
 
 	default:
-		record = &dns.A{
+		return &dns.A{
 			Hdr: dns.RR_Header{
 				Name:   name,
 				Rrtype: dns.TypeA,
@@ -73,10 +127,6 @@ func (c *HandlerConfig) AddNetipAddr(name string, addr netip.Addr) {
 			A: addr.AsSlice(),
 		}
 	}
-
-	c.mu.Lock()
-	c.rrs[name] = append(c.rrs[name], record)
-	c.mu.Unlock()
 }
 
 // AddCNAME adds a CNAME alias record for the given name.
@@ -94,29 +144,100 @@ func (c *HandlerConfig) AddCNAME(name, cname string) {
 	}
 
 	c.mu.Lock()
-	c.rrs[name] = append(c.rrs[name], record)
+	c.addRRsLocked(name, record)
 	c.mu.Unlock()
 }
 
 // Remove removes records from the [*HandlerConfig].
 func (c *HandlerConfig) Remove(name string) {
+	name = dns.CanonicalName(name)
 	c.mu.Lock()
-	delete(c.rrs, dns.CanonicalName(name))
+	if c.ownerLocked(name) {
+		for label := range ancestorNames(name) {
+			if c.names[label]--; c.names[label] <= 0 {
+				delete(c.names, label)
+			}
+		}
+	}
+	delete(c.rrs, name)
+	delete(c.subnets, name)
 	c.mu.Unlock()
 }
 
+// addRRsLocked adds records for the given canonical name.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) addRRsLocked(name string, records ...dns.RR) {
+	c.addOwnerLocked(name)
+	c.rrs[name] = append(c.rrs[name], records...)
+}
+
+// addOwnerLocked records that the given canonical name and its ancestors
+// exist, which MUST be called before adding records for the name.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) addOwnerLocked(name string) {
+	if c.ownerLocked(name) {
+		return
+	}
+	for label := range ancestorNames(name) {
+		c.names[label]++
+	}
+}
+
+// ownerLocked returns whether the name has records, including the ones
+// for specific client subnets.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) ownerLocked(name string) bool {
+	_, inRRs := c.rrs[name]
+	_, inSubnets := c.subnets[name]
+	return inRRs || inSubnets
+}
+
+// ancestorNames returns an iterator over the given canonical name
+// and its ancestors, including the root.
+func ancestorNames(name string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for {
+			if !yield(name) || name == "." {
+				return
+			}
+			_, parent, _ := strings.Cut(name, ".")
+			name = dns.CanonicalName(parent)
+		}
+	}
+}
+
 // Lookup searches for a name inside the [*HandlerConfig].
 //
 // A false return value indicates that the record does not exist
 // while a true return value without records indicates that we don't
 // have records for the given type.
+//
+// Within signed zones (see [*HandlerConfig.SignZone]), empty non-terminals
+// (i.e., names without records having descendants with records) exist, and,
+// when the name does not exist and there is a wildcard (e.g., *.example.com)
+// at the closest encloser, we synthesize the records from the wildcard by
+// replacing the owner name (see RFC 4592). Outside of signed zones, names
+// only exist when they have records and wildcards are regular names.
 func (c *HandlerConfig) Lookup(name string, qtype uint16) ([]dns.RR, bool) {
 	var filtered []dns.RR
+	name = dns.CanonicalName(name)
 	c.mu.Lock()
 
-	records, found := c.rrs[dns.CanonicalName(name)]
+	records, found := c.rrs[name]
+	if !found {
+		if wildcard, ok := c.wildcardLocked(name); ok {
+			records, found = c.rrs[wildcard], true
+		} else {
+			found = c.existsLocked(name)
+		}
+	}
 	for _, rr := range records {
 		if qtype == rr.Header().Rrtype {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
 			filtered = append(filtered, rr)
 		}
 	}
@@ -125,6 +246,49 @@ func (c *HandlerConfig) Lookup(name string, qtype uint16) ([]dns.RR, bool) {
 	return filtered, found
 }
 
+// existsLocked returns whether the name has records, including the ones
+// for specific client subnets, or, within signed zones, descendants with records.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) existsLocked(name string) bool {
+	return c.ownerLocked(name) || (c.names[name] > 0 && c.signedLocked(name))
+}
+
+// signedLocked returns whether the canonical name belongs to a signed zone.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) signedLocked(name string) bool {
+	return c.findZoneLocked(name, dns.TypeNone) != nil
+}
+
+// closestEncloserLocked returns the closest existing ancestor of the given
+// name that does not exist, or the root when no ancestor exists.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) closestEncloserLocked(name string) string {
+	for name != "." {
+		_, parent, _ := strings.Cut(name, ".")
+		name = dns.CanonicalName(parent)
+		if c.existsLocked(name) {
+			break
+		}
+	}
+	return name
+}
+
+// wildcardLocked returns the wildcard name from which we should synthesize
+// the records of the given name, if any, which requires a signed zone.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) wildcardLocked(name string) (string, bool) {
+	if !c.signedLocked(name) || c.existsLocked(name) {
+		return "", false
+	}
+	wildcard := "*." + strings.TrimPrefix(c.closestEncloserLocked(name), ".")
+	_, found := c.rrs[wildcard]
+	return wildcard, found
+}
+
 // Handler is a [dns.Handler] using [*HandlerConfig] to serve responses.
 //
 // Construct using [NewHandler].
@@ -142,11 +306,69 @@ var _ dns.Handler = &Handler{}
 
 // ServeDNS implements [dns.Handler].
 func (h *Handler) ServeDNS(rw dns.ResponseWriter, query *dns.Msg) {
-	rw.WriteMsg(h.PrepareResponse(query))
+	rw.WriteMsg(h.prepareResponse(rw, query))
 }
 
 // PrepareResponse returns a [*dns.Msg] response for the given [*dns.Msg] query.
+//
+// Because there is no [dns.ResponseWriter], the response does not depend on
+// the client address (e.g., the server cookie uses an empty client address).
 func (h *Handler) PrepareResponse(query *dns.Msg) *dns.Msg {
+	return h.prepareResponse(nil, query)
+}
+
+// prepareResponse implements ServeDNS and PrepareResponse. The rw argument
+// is nil when the caller is PrepareResponse.
+func (h *Handler) prepareResponse(rw dns.ResponseWriter, query *dns.Msg) *dns.Msg {
+	// 1. select the view to use for this client, without selecting
+	// among the views of the view, which could otherwise loop forever
+	h = NewHandler(h.cfg.selectView(rw))
+
+	// 2. check the DNS cookies before answering
+	cookie, rcode := h.cfg.checkCookie(rw, query)
+	var resp *dns.Msg
+	switch rcode {
+	case dns.RcodeSuccess:
+		resp = h.answer(query)
+	default:
+		resp = &dns.Msg{}
+		resp.SetRcode(query, rcode)
+	}
+
+	// 3. finalize the response and include the server cookie
+	h.finalize(query, resp)
+	if opt := resp.IsEdns0(); opt != nil && cookie != nil {
+		opt.Option = append(opt.Option, cookie)
+	}
+	return resp
+}
+
+// handlerEDNS0Size is the EDNS0 UDP payload size used by [*Handler].
+const handlerEDNS0Size = 1232
+
+// finalize applies the DNSSEC faults and adds to the response the denial
+// of existence for signed zones, the EDNS0 OPT record with the client
+// subnet and the extended DNS errors, when the query contains one, and
+// the DNSSEC signatures, when the DO bit is set. Then, it sets the
+// header flags.
+func (h *Handler) finalize(query, resp *dns.Msg) {
+	opt := query.IsEdns0()
+	do := opt != nil && opt.Do()
+	h.cfg.applyDNSSECFaults(resp)
+	h.cfg.addDenial(query, resp, do)
+	if opt != nil {
+		resp.SetEdns0(handlerEDNS0Size, do)
+		h.cfg.addECS(query, resp)
+		h.cfg.addEDE(query, resp)
+	}
+	if do {
+		h.cfg.signResponse(resp)
+	}
+	h.cfg.applyHeaderFlags(query, resp)
+}
+
+// answer returns the response for the query without EDNS0 and DNSSEC.
+func (h *Handler) answer(query *dns.Msg) *dns.Msg {
 	// 1. reject blatantly wrong queries
 	if query.Response || len(query.Question) != 1 {
 		resp := &dns.Msg{}
@@ -167,15 +389,24 @@ func (h *Handler) PrepareResponse(query *dns.Msg) *dns.Msg {
 	qName, qType := q0.Name, q0.Qtype
 	const maxCNAMEChain = 10
 	for range maxCNAMEChain {
-		// 3.1. execute the query requested by the user
+		// 3.1. execute the query requested by the user, preferring the
+		// records matching the EDNS0 client subnet, if any
 		records, found := h.cfg.Lookup(qName, qType)
+		if !found {
+			records, found = h.cfg.lookupDNS64WellKnown(qName, qType)
+		}
+		if subnetRecords, _ := h.cfg.lookupSubnet(qName, qType, query); len(subnetRecords) > 0 {
+			records, found = subnetRecords, true
+		}
 
 		switch {
 		// 3.2. the query returned records
 		case found && len(records) > 0:
+			records = h.cfg.applyRecordOrder(qName, records)
 			resp := &dns.Msg{}
 			resp.SetReply(query)
 			resp.Answer = append(cnames, records...)
+			resp.Extra = h.svcbAdditionals(records)
 			return resp
 
 		// 3.3. no records but the name exists
@@ -191,10 +422,20 @@ func (h *Handler) PrepareResponse(query *dns.Msg) *dns.Msg {
 				// so Config.Lookup only returns CNAME records.
 				qName = records[0].(*dns.CNAME).Target
 
-			// 3.3.3. otherwise, NOERROR (name exists but type not found)
+			// 3.3.3. otherwise, NOERROR (name exists but type not found),
+			// unless we can synthesize the AAAA records using DNS64
 			default:
 				resp := &dns.Msg{}
-				resp.SetReply(query) // NOERROR, empty answer
+				resp.SetReply(query) // NOERROR, possibly empty answer
+				var synthesized []dns.RR
+				if qType == dns.TypeAAAA {
+					synthesized = h.cfg.synthesizeDNS64(qName, query)
+				}
+				if len(synthesized) > 0 {
+					resp.Answer = append(cnames, synthesized...)
+					return resp
+				}
+				resp.Answer = h.cfg.negativeCNAMEs(qName, cnames)
 				return resp
 			}
 
@@ -202,6 +443,7 @@ func (h *Handler) PrepareResponse(query *dns.Msg) *dns.Msg {
 		default:
 			resp := &dns.Msg{}
 			resp.SetRcode(query, dns.RcodeNameError)
+			resp.Answer = h.cfg.negativeCNAMEs(qName, cnames)
 			return resp
 		}
 	}
@@ -50,6 +50,120 @@ func TestHandlerConfigClone(t *testing.T) {
 	assert.True(t, len(rrs) == 0)
 }
 
+func TestHandlerConfigLookupWildcardsAndEmptyNonTerminals(t *testing.T) {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("*.example.com", netip.MustParseAddr("1.1.1.1"))
+	config.AddNetipAddr("www.a.example.com", netip.MustParseAddr("8.8.8.8"))
+	config.SignZone("example.com")
+
+	type testCase struct {
+		name        string
+		qname       string
+		expectFound bool
+		expectAddrs []string
+	}
+
+	testCases := []testCase{
+		{"the wildcard matches a nonexistent name", "foo.example.com", true, []string{"1.1.1.1"}},
+		{"the wildcard matches multiple labels", "foo.bar.example.com", true, []string{"1.1.1.1"}},
+		{"the existing name has precedence", "www.a.example.com", true, []string{"8.8.8.8"}},
+		{"the empty non-terminal exists", "a.example.com", true, nil},
+		{"the empty non-terminal blocks the wildcard", "foo.a.example.com", false, nil},
+		{"the wildcard does not match the parent", "example.org", false, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rrs, found := config.Lookup(tc.qname, dns.TypeA)
+			assert.Equal(t, tc.expectFound, found)
+			for _, rr := range rrs {
+				assert.Equal(t, dns.CanonicalName(tc.qname), rr.Header().Name)
+			}
+			assert.Equal(t, tc.expectAddrs, collectAddrs(&dns.Msg{Answer: rrs}))
+		})
+	}
+}
+
+func TestHandlerConfigLookupUnsignedNames(t *testing.T) {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("*.example.com", netip.MustParseAddr("1.1.1.1"))
+	config.AddNetipAddr("www.a.example.com", netip.MustParseAddr("8.8.8.8"))
+	config.AddNetipAddr("www.b.example.com", netip.MustParseAddr("9.9.9.9"))
+	config.Remove("www.b.example.com")
+
+	type testCase struct {
+		name        string
+		qname       string
+		expectFound bool
+		expectAddrs []string
+	}
+
+	testCases := []testCase{
+		{"the wildcard only matches itself", "*.example.com", true, []string{"1.1.1.1"}},
+		{"the wildcard does not match a nonexistent name", "foo.example.com", false, nil},
+		{"the existing name is found", "www.a.example.com", true, []string{"8.8.8.8"}},
+		{"the empty non-terminal does not exist", "a.example.com", false, nil},
+		{"the removed name does not exist", "www.b.example.com", false, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rrs, found := config.Lookup(tc.qname, dns.TypeA)
+			assert.Equal(t, tc.expectFound, found)
+			assert.Equal(t, tc.expectAddrs, collectAddrs(&dns.Msg{Answer: rrs}))
+		})
+	}
+
+	t.Run("the removed name is not an empty non-terminal once signed", func(t *testing.T) {
+		config := config.Clone()
+		config.SignZone("example.com")
+		rrs, found := config.Lookup("b.example.com", dns.TypeA)
+		assert.True(t, found) // synthesized from the wildcard
+		assert.Equal(t, []string{"1.1.1.1"}, collectAddrs(&dns.Msg{Answer: rrs}))
+		rrs, found = config.Lookup("a.example.com", dns.TypeA)
+		assert.True(t, found) // empty non-terminal
+		assert.Empty(t, rrs)
+	})
+}
+
+func TestHandlerNegativeAnswersThroughCNAME(t *testing.T) {
+	type testCase struct {
+		name         string
+		signed       bool
+		qname        string
+		expectRcode  int
+		expectCNAMEs []string
+	}
+
+	testCases := []testCase{
+		{"unsigned NODATA omits the CNAME", false, "nodata.example.com", dns.RcodeSuccess, nil},
+		{"unsigned NXDOMAIN omits the CNAME", false, "nxdomain.example.com", dns.RcodeNameError, nil},
+		{"signed NODATA includes the CNAME", true, "nodata.example.com", dns.RcodeSuccess,
+			[]string{"www.example.com."}},
+		{"signed NXDOMAIN includes the CNAME", true, "nxdomain.example.com", dns.RcodeNameError,
+			[]string{"missing.example.com."}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewHandlerConfig()
+			config.AddNetipAddr("www.example.com", netip.MustParseAddr("1.1.1.1"))
+			config.AddCNAME("nodata.example.com", "www.example.com")
+			config.AddCNAME("nxdomain.example.com", "missing.example.com")
+			if tc.signed {
+				config.SignZone("example.com")
+			}
+
+			query := &dns.Msg{}
+			query.SetQuestion(dns.CanonicalName(tc.qname), dns.TypeTXT)
+			resp := NewHandler(config).PrepareResponse(query)
+
+			assert.Equal(t, tc.expectRcode, resp.Rcode)
+			assert.Equal(t, tc.expectCNAMEs, collectCNAMEs(resp.Answer))
+		})
+	}
+}
+
 // collectAddrs extracts all A and AAAA records from a DNS message's Answer section
 // and returns them as a sorted slice of strings for stable comparison.
 func collectAddrs(resp *dns.Msg) (output []string) {
@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import "github.com/miekg/dns"
+
+// HeaderFlag configures a response header bit within [HeaderFlags].
+type HeaderFlag int
+
+const (
+	// HeaderFlagDefault leaves the bit as the handler sets it when not
+	// using [*HandlerConfig.SetHeaderFlags], i.e., it copies the RD bit
+	// from the query and clears the other bits.
+	HeaderFlagDefault = HeaderFlag(iota)
+
+	// HeaderFlagAuto uses the automatic logic documented by each
+	// field of [HeaderFlags] to decide whether to set the bit.
+	HeaderFlagAuto
+
+	// HeaderFlagSet always sets the bit.
+	HeaderFlagSet
+
+	// HeaderFlagClear always clears the bit.
+	HeaderFlagClear
+)
+
+// HeaderFlags configures the response header bits.
+//
+// The zero value uses [HeaderFlagDefault] for all the bits.
+type HeaderFlags struct {
+	// AA is the authoritative answer bit. The automatic logic sets it when
+	// the handler answers using its own data, i.e., for NOERROR and NXDOMAIN
+	// responses, and clears it for errors (e.g., SERVFAIL or BADCOOKIE).
+	AA HeaderFlag
+
+	// AD is the authenticated data bit. The automatic logic emulates
+	// a validating resolver and sets it when the query sets either the
+	// DO or the AD bit and all the RRsets in the answer and authority
+	// sections belong to signed zones without a [DNSSECFault].
+	AD HeaderFlag
+
+	// RA is the recursion available bit. The automatic logic clears it.
+	RA HeaderFlag
+
+	// RD is the recursion desired bit. The automatic logic copies it from the query.
+	RD HeaderFlag
+
+	// TC is the truncated bit. The automatic logic clears it. Note that
+	// setting it does not remove records from the response.
+	TC HeaderFlag
+
+	// Z is the reserved bit. The automatic logic clears it.
+	Z HeaderFlag
+}
+
+// SetHeaderFlags sets the [HeaderFlags] used by the [*Handler].
+//
+// This method is safe to call while the handler is running.
+func (c *HandlerConfig) SetHeaderFlags(flags HeaderFlags) {
+	c.mu.Lock()
+	c.flags = flags
+	c.mu.Unlock()
+}
+
+// resolve returns the bit value according to the flag, the current value,
+// and the automatic value.
+func (f HeaderFlag) resolve(current bool, auto func() bool) bool {
+	switch f {
+	case HeaderFlagAuto:
+		return auto()
+	case HeaderFlagSet:
+		return true
+	case HeaderFlagClear:
+		return false
+	default:
+		return current
+	}
+}
+
+// applyHeaderFlags sets the header bits of the response according to the [HeaderFlags].
+func (c *HandlerConfig) applyHeaderFlags(query, resp *dns.Msg) {
+	c.mu.Lock()
+	flags := c.flags
+	c.mu.Unlock()
+
+	resp.Authoritative = flags.AA.resolve(resp.Authoritative, func() bool {
+		return resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError
+	})
+	resp.AuthenticatedData = flags.AD.resolve(resp.AuthenticatedData, func() bool {
+		opt := query.IsEdns0()
+		return (query.AuthenticatedData || (opt != nil && opt.Do())) && c.authenticated(resp)
+	})
+	resp.RecursionAvailable = flags.RA.resolve(resp.RecursionAvailable, func() bool { return false })
+	resp.RecursionDesired = flags.RD.resolve(resp.RecursionDesired, func() bool { return query.RecursionDesired })
+	resp.Truncated = flags.TC.resolve(resp.Truncated, func() bool { return false })
+	resp.Zero = flags.Z.resolve(resp.Zero, func() bool { return false })
+}
+
+// authenticated returns whether the response contains at least a record and
+// all the records in the answer and authority sections belong to signed
+// zones such that neither the zone nor its signed ancestors have a [DNSSECFault].
+func (c *HandlerConfig) authenticated(resp *dns.Msg) bool {
+	var count int
+	for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Ns...) {
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeRRSIG {
+			continue
+		}
+		sz := c.findZone(rr.Header().Name, rrtype)
+		if sz == nil {
+			return false
+		}
+		for ; sz != nil; sz = c.findZone(sz.Name(), dns.TypeDS) {
+			if sz.Fault() != DNSSECFaultNone {
+				return false
+			}
+		}
+		count++
+	}
+	return count > 0
+}
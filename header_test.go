@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerHeaderFlags(t *testing.T) {
+	// expectBits contains the expected response header bits.
+	type expectBits struct {
+		AA, AD, CD, RA, RD, TC, Z bool
+	}
+
+	type testCase struct {
+		name      string
+		flags     HeaderFlags
+		fault     DNSSECFault
+		configure func(config *HandlerConfig)
+		getQuery  func() *dns.Msg
+		expectHdr expectBits
+	}
+
+	// newQuery creates a query for the given name with the given DO bit.
+	newQuery := func(name string, do bool) func() *dns.Msg {
+		return func() *dns.Msg {
+			return newDNSSECTestQuery(name, dns.TypeA, do)
+		}
+	}
+
+	auto := HeaderFlags{
+		AA: HeaderFlagAuto,
+		AD: HeaderFlagAuto,
+		RA: HeaderFlagAuto,
+		RD: HeaderFlagAuto,
+		TC: HeaderFlagAuto,
+		Z:  HeaderFlagAuto,
+	}
+
+	all := HeaderFlags{
+		AA: HeaderFlagSet,
+		AD: HeaderFlagSet,
+		RA: HeaderFlagSet,
+		RD: HeaderFlagSet,
+		TC: HeaderFlagSet,
+		Z:  HeaderFlagSet,
+	}
+
+	none := HeaderFlags{
+		AA: HeaderFlagClear,
+		AD: HeaderFlagClear,
+		RA: HeaderFlagClear,
+		RD: HeaderFlagClear,
+		TC: HeaderFlagClear,
+		Z:  HeaderFlagClear,
+	}
+
+	testCases := []testCase{
+		{
+			name:      "default for a signed zone with DO",
+			getQuery:  newQuery("www.example.com", true),
+			expectHdr: expectBits{RD: true},
+		},
+
+		{
+			name:      "default for an unsigned zone",
+			getQuery:  newQuery("www.example.org", false),
+			expectHdr: expectBits{RD: true},
+		},
+
+		{
+			name: "default echoes CD and RD",
+			getQuery: func() *dns.Msg {
+				query := newDNSSECTestQuery("www.example.org", dns.TypeA, false)
+				query.CheckingDisabled = true
+				query.RecursionDesired = false
+				return query
+			},
+			expectHdr: expectBits{CD: true},
+		},
+
+		{
+			name:      "automatic for an unsigned zone",
+			flags:     auto,
+			getQuery:  newQuery("www.example.org", true),
+			expectHdr: expectBits{AA: true, RD: true},
+		},
+
+		{
+			name:      "automatic for an unsigned NXDOMAIN",
+			flags:     auto,
+			getQuery:  newQuery("nonexistent.example.org", false),
+			expectHdr: expectBits{AA: true, RD: true},
+		},
+
+		{
+			name:  "automatic for an unsigned NODATA",
+			flags: auto,
+			getQuery: func() *dns.Msg {
+				return newDNSSECTestQuery("www.example.org", dns.TypeTXT, false)
+			},
+			expectHdr: expectBits{AA: true, RD: true},
+		},
+
+		{
+			name:  "automatic for SERVFAIL",
+			flags: auto,
+			configure: func(config *HandlerConfig) {
+				config.AddCNAME("loop.example.org", "loop.example.org")
+			},
+			getQuery:  newQuery("loop.example.org", false),
+			expectHdr: expectBits{RD: true},
+		},
+
+		{
+			name:  "automatic for REFUSED",
+			flags: auto,
+			getQuery: func() *dns.Msg {
+				query := newDNSSECTestQuery("www.example.org", dns.TypeA, false)
+				query.Question[0].Qclass = dns.ClassCHAOS
+				return query
+			},
+			expectHdr: expectBits{RD: true},
+		},
+
+		{
+			name:  "automatic for FORMERR",
+			flags: auto,
+			configure: func(config *HandlerConfig) {
+				config.SetCookieMode(CookieModeEnabled)
+			},
+			getQuery:  func() *dns.Msg { return newCookieTestQuery("01020304") },
+			expectHdr: expectBits{RD: true},
+		},
+
+		{
+			name:  "automatic for BADCOOKIE",
+			flags: auto,
+			configure: func(config *HandlerConfig) {
+				config.SetCookieMode(CookieModeEnforced)
+			},
+			getQuery:  func() *dns.Msg { return newCookieTestQuery(cookieTestClientCookie) },
+			expectHdr: expectBits{RD: true},
+		},
+
+		{
+			name:      "automatic for a signed zone with DO",
+			flags:     auto,
+			getQuery:  newQuery("www.example.com", true),
+			expectHdr: expectBits{AA: true, AD: true, RD: true},
+		},
+
+		{
+			name:      "automatic for a signed zone without DO",
+			flags:     auto,
+			getQuery:  newQuery("www.example.com", false),
+			expectHdr: expectBits{AA: true, RD: true},
+		},
+
+		{
+			name:  "automatic for a signed zone with AD",
+			flags: auto,
+			getQuery: func() *dns.Msg {
+				query := &dns.Msg{}
+				query.SetQuestion("www.example.com.", dns.TypeA)
+				query.AuthenticatedData = true
+				return query
+			},
+			expectHdr: expectBits{AA: true, AD: true, RD: true},
+		},
+
+		{
+			name:      "automatic for a signed NXDOMAIN with DO",
+			flags:     auto,
+			getQuery:  newQuery("nonexistent.example.com", true),
+			expectHdr: expectBits{AA: true, AD: true, RD: true},
+		},
+
+		{
+			name:      "automatic for a broken parent zone",
+			flags:     auto,
+			fault:     DNSSECFaultStrippedSignatures,
+			getQuery:  newQuery("www.example.com", true),
+			expectHdr: expectBits{AA: true, RD: true},
+		},
+
+		{
+			name:  "automatic echoes CD and RD",
+			flags: auto,
+			getQuery: func() *dns.Msg {
+				query := newDNSSECTestQuery("www.example.org", dns.TypeA, false)
+				query.CheckingDisabled = true
+				query.RecursionDesired = false
+				return query
+			},
+			expectHdr: expectBits{AA: true, CD: true},
+		},
+
+		{
+			name:      "all the bits set",
+			flags:     all,
+			getQuery:  newQuery("www.example.org", false),
+			expectHdr: expectBits{AA: true, AD: true, RA: true, RD: true, TC: true, Z: true},
+		},
+
+		{
+			name:      "all the bits cleared",
+			flags:     none,
+			getQuery:  newQuery("www.example.com", true),
+			expectHdr: expectBits{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// create config
+			config := NewHandlerConfig()
+			parent := config.SignZone("com")
+			config.SignZone("example.com")
+			config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+			config.AddNetipAddr("www.example.org", netip.MustParseAddr("8.8.8.8"))
+			config.SetHeaderFlags(tc.flags)
+			parent.SetFault(tc.fault)
+			if tc.configure != nil {
+				tc.configure(config)
+			}
+
+			// make sure the bits survive the round trip
+			resp := NewHandler(config).PrepareResponse(tc.getQuery())
+			rawResp, err := resp.Pack()
+			assert.NoError(t, err)
+			resp = &dns.Msg{}
+			assert.NoError(t, resp.Unpack(rawResp))
+
+			assert.Equal(t, tc.expectHdr, expectBits{
+				AA: resp.Authoritative,
+				AD: resp.AuthenticatedData,
+				CD: resp.CheckingDisabled,
+				RA: resp.RecursionAvailable,
+				RD: resp.RecursionDesired,
+				TC: resp.Truncated,
+				Z:  resp.Zero,
+			})
+		})
+	}
+}
+
+func TestHandlerConfigCloneKeepsHeaderFlags(t *testing.T) {
+	config := NewHandlerConfig()
+	config.SetHeaderFlags(HeaderFlags{RA: HeaderFlagSet})
+	resp := NewHandler(config.Clone()).PrepareResponse(newDNSSECTestQuery("example.com", dns.TypeA, false))
+	assert.True(t, resp.RecursionAvailable)
+}
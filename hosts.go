@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// HostsAliasMode configures how [*HandlerConfig.AddHosts] handles aliases.
+type HostsAliasMode int
+
+const (
+	// HostsAliasAddrs adds to each alias the same address records of the
+	// canonical name, which is how the system resolver uses hosts files.
+	HostsAliasAddrs = HostsAliasMode(iota)
+
+	// HostsAliasCNAME adds for each alias a CNAME record pointing to the
+	// canonical name. An alias cannot point to distinct canonical names nor
+	// be a canonical name itself, since a CNAME cannot coexist with other records.
+	HostsAliasCNAME
+)
+
+// hostsEntry is an address record or a CNAME record parsed from a hosts file.
+type hostsEntry struct {
+	// addr is the address, which is invalid for CNAME records.
+	addr netip.Addr
+
+	// name is the canonical owner name.
+	name string
+
+	// target is the canonical CNAME target, which is empty for address records.
+	target string
+}
+
+// AddHosts reads hosts-format content (see hosts(5)) and adds its records to
+// the [*HandlerConfig]. Each line contains an IPv4 or IPv6 address followed by
+// the canonical name and by zero or more aliases, and the "#" character starts
+// a comment extending to the end of the line. The canonical name maps to the
+// addresses of all the lines where it appears, while the [HostsAliasMode]
+// configures how to handle the aliases. Duplicate records are ignored.
+//
+// On failure, this method returns an error mentioning the offending line
+// number and does not modify the [*HandlerConfig].
+func (c *HandlerConfig) AddHosts(r io.Reader, mode HostsAliasMode) error {
+	entries, err := parseHosts(r, mode)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch entry.addr.IsValid() {
+		case true:
+			c.AddNetipAddr(entry.name, entry.addr)
+		default:
+			c.AddCNAME(entry.name, entry.target)
+		}
+	}
+	return nil
+}
+
+// MustAddHosts is like [*HandlerConfig.AddHosts] but PANICS on failure.
+func (c *HandlerConfig) MustAddHosts(r io.Reader, mode HostsAliasMode) {
+	runtimex.PanicOnError0(c.AddHosts(r, mode))
+}
+
+// parseHosts parses hosts-format content into deduplicated entries.
+func parseHosts(r io.Reader, mode HostsAliasMode) ([]hostsEntry, error) {
+	var (
+		canonical = map[string]int{}
+		entries   []hostsEntry
+		lineno    int
+		seen      = map[hostsEntry]bool{}
+		targets   = map[string]string{}
+	)
+
+	// add appends the entry unless we have already seen it.
+	add := func(entry hostsEntry) {
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineno++
+
+		// 1. strip comments and skip empty lines
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) <= 0 {
+			continue
+		}
+
+		// 2. parse the address and the names
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("dnstest: hosts line %d: missing host name", lineno)
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("dnstest: hosts line %d: invalid address %q", lineno, fields[0])
+		}
+		addr = addr.WithZone("")
+		names := make([]string, 0, len(fields)-1)
+		for _, field := range fields[1:] {
+			if _, ok := dns.IsDomainName(field); !ok {
+				return nil, fmt.Errorf("dnstest: hosts line %d: invalid host name %q", lineno, field)
+			}
+			names = append(names, dns.CanonicalName(field))
+		}
+
+		// 3. add the records of the canonical name
+		name := names[0]
+		if _, found := targets[name]; found {
+			return nil, fmt.Errorf("dnstest: hosts line %d: %q is both an alias and a canonical name", lineno, name)
+		}
+		canonical[name] = lineno
+		add(hostsEntry{addr: addr, name: name})
+
+		// 4. add the records of the aliases
+		for _, alias := range names[1:] {
+			if alias == name {
+				continue
+			}
+			switch mode {
+			case HostsAliasCNAME:
+				if target, found := targets[alias]; found && target != name {
+					return nil, fmt.Errorf("dnstest: hosts line %d: alias %q points to both %q and %q",
+						lineno, alias, target, name)
+				}
+				if other, found := canonical[alias]; found {
+					return nil, fmt.Errorf("dnstest: hosts line %d: %q is both an alias and the canonical name at line %d",
+						lineno, alias, other)
+				}
+				targets[alias] = name
+				add(hostsEntry{name: alias, target: name})
+
+			default:
+				add(hostsEntry{addr: addr, name: alias})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("dnstest: hosts line %d: %w", lineno+1, err)
+	}
+	return entries, nil
+}
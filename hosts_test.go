@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// hostsTestContent is the hosts-format content used by the tests.
+const hostsTestContent = `# this is a comment
+
+127.0.0.1	localhost
+::1		localhost ip6-localhost	# trailing comment
+192.0.2.1	www.example.com example.com www
+192.0.2.2	www.example.com
+2001:db8::1	www.example.com
+fe80::1%lo0	link.example.com
+`
+
+func TestHandlerConfigAddHosts(t *testing.T) {
+	type testCase struct {
+		name         string
+		mode         HostsAliasMode
+		qname        string
+		qtype        uint16
+		expectCNAMEs []string
+		expectAddrs  []string
+	}
+
+	testCases := []testCase{
+		{
+			name:        "canonical name A",
+			qname:       "www.example.com",
+			qtype:       dns.TypeA,
+			expectAddrs: []string{"192.0.2.1", "192.0.2.2"},
+		},
+
+		{
+			name:        "canonical name AAAA",
+			qname:       "www.example.com",
+			qtype:       dns.TypeAAAA,
+			expectAddrs: []string{"2001:db8::1"},
+		},
+
+		{
+			name:        "localhost on multiple lines",
+			qname:       "localhost",
+			qtype:       dns.TypeAAAA,
+			expectAddrs: []string{"::1"},
+		},
+
+		{
+			name:        "link-local address without zone",
+			qname:       "link.example.com",
+			qtype:       dns.TypeAAAA,
+			expectAddrs: []string{"fe80::1"},
+		},
+
+		{
+			name:        "alias with address records",
+			mode:        HostsAliasAddrs,
+			qname:       "example.com",
+			qtype:       dns.TypeA,
+			expectAddrs: []string{"192.0.2.1"},
+		},
+
+		{
+			name:         "alias with CNAME records",
+			mode:         HostsAliasCNAME,
+			qname:        "example.com",
+			qtype:        dns.TypeA,
+			expectCNAMEs: []string{"www.example.com."},
+			expectAddrs:  []string{"192.0.2.1", "192.0.2.2"},
+		},
+
+		{
+			name:         "unqualified alias with CNAME records",
+			mode:         HostsAliasCNAME,
+			qname:        "www",
+			qtype:        dns.TypeAAAA,
+			expectCNAMEs: []string{"www.example.com."},
+			expectAddrs:  []string{"2001:db8::1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewHandlerConfig()
+			assert.NoError(t, config.AddHosts(strings.NewReader(hostsTestContent), tc.mode))
+
+			query := &dns.Msg{}
+			query.SetQuestion(dns.CanonicalName(tc.qname), tc.qtype)
+			resp := NewHandler(config).PrepareResponse(query)
+
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			assert.Equal(t, tc.expectCNAMEs, collectCNAMEs(resp.Answer))
+			assert.Equal(t, tc.expectAddrs, collectAddrs(resp))
+		})
+	}
+}
+
+func TestHandlerConfigAddHostsDeduplicates(t *testing.T) {
+	config := NewHandlerConfig()
+	config.MustAddHosts(strings.NewReader("192.0.2.1 a.example b.example\n192.0.2.1 a.example b.example\n"), HostsAliasCNAME)
+	records, found := config.Lookup("a.example", dns.TypeA)
+	assert.True(t, found)
+	assert.Len(t, records, 1)
+	records, found = config.Lookup("b.example", dns.TypeCNAME)
+	assert.True(t, found)
+	assert.Len(t, records, 1)
+}
+
+func TestHandlerConfigAddHostsErrors(t *testing.T) {
+	type testCase struct {
+		name      string
+		content   string
+		mode      HostsAliasMode
+		expectErr string
+	}
+
+	testCases := []testCase{
+		{
+			name:      "missing host name",
+			content:   "# comment\n192.0.2.1\n",
+			expectErr: "dnstest: hosts line 2: missing host name",
+		},
+
+		{
+			name:      "invalid address",
+			content:   "192.0.2.1 a.example\n192.0.2.256 b.example\n",
+			expectErr: `dnstest: hosts line 2: invalid address "192.0.2.256"`,
+		},
+
+		{
+			name:      "invalid host name",
+			content:   "192.0.2.1 a..example\n",
+			expectErr: `dnstest: hosts line 1: invalid host name "a..example"`,
+		},
+
+		{
+			name:      "alias pointing to distinct names",
+			content:   "192.0.2.1 a.example c.example\n192.0.2.2 b.example c.example\n",
+			mode:      HostsAliasCNAME,
+			expectErr: `dnstest: hosts line 2: alias "c.example." points to both "a.example." and "b.example."`,
+		},
+
+		{
+			name:      "alias after canonical name",
+			content:   "192.0.2.1 a.example\n192.0.2.2 b.example a.example\n",
+			mode:      HostsAliasCNAME,
+			expectErr: `dnstest: hosts line 2: "a.example." is both an alias and the canonical name at line 1`,
+		},
+
+		{
+			name:      "canonical name after alias",
+			content:   "192.0.2.1 a.example b.example\n192.0.2.2 b.example\n",
+			mode:      HostsAliasCNAME,
+			expectErr: `dnstest: hosts line 2: "b.example." is both an alias and a canonical name`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewHandlerConfig()
+			err := config.AddHosts(strings.NewReader(tc.content), tc.mode)
+			assert.EqualError(t, err, tc.expectErr)
+
+			// make sure we did not add any record
+			_, found := config.Lookup("a.example", dns.TypeA)
+			assert.False(t, found)
+			assert.Panics(t, func() {
+				config.MustAddHosts(strings.NewReader(tc.content), tc.mode)
+			})
+		})
+	}
+}
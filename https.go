@@ -5,10 +5,13 @@ package dnstest
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/bassosimone/runtimex"
@@ -36,21 +39,50 @@ func newUnstartedServer(handler http.Handler) *httptest.Server {
 
 // MustNewHTTPSServer returns a new [*HTTPSServer] ready to use.
 //
+// When the query includes the EDNS0 padding option, the server pads the
+// response written by the handler to a multiple of 468 bytes (see RFC 8467).
+// Use PaddingLengths to inspect the padding length used by the queries.
+//
 // This method PANICS on failure.
 func MustNewHTTPSServer(
-	lc HTTPSListenConfig, address string, cert tls.Certificate, handler *Handler) *HTTPSServer {
-	listener := runtimex.PanicOnError1(lc.Listen(context.Background(), "tcp", address))
-	hs := newUnstartedServer(HTTPSHandler{handler})
-	hs.Listener = listener
-	hs.TLS = &tls.Config{
+	lc HTTPSListenConfig, address string, cert tls.Certificate, handler dns.Handler) *HTTPSServer {
+	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
-	hs.EnableHTTP2 = true
-	hs.StartTLS()
+	return MustNewHTTPSServerWithConfig(lc, address, config, handler)
+}
+
+// MustNewHTTPSServerWithConfig is like [MustNewHTTPSServer] but uses the given
+// [*tls.Config], which allows to control, e.g., the TLS versions, the cipher
+// suites, the ALPN protocols, and session tickets.
+//
+// The config MUST contain at least a certificate (or a GetCertificate
+// callback). We clone the config, so the caller may reuse it. When the
+// config does not set NextProtos, the server only offers "h2". The config
+// KeyLogWriter, if set, is the initial [*HTTPSServer.SetKeyLogWriter] value.
+//
+// This method PANICS on failure.
+func MustNewHTTPSServerWithConfig(
+	lc HTTPSListenConfig, address string, config *tls.Config, handler dns.Handler) *HTTPSServer {
+	listener := newTLSFaultListener(runtimex.PanicOnError1(lc.Listen(context.Background(), "tcp", address)))
+	config = config.Clone()
+	padding := newPaddingHandler(handler)
 	srv := &HTTPSServer{
-		address: listener.Addr().String(),
-		srv:     hs,
+		address:   listener.Addr().String(),
+		fault:     nil,
+		handler:   HTTPSHandler{DNSHandler: padding},
+		inspector: newTLSInspector(config),
+		listener:  listener,
+		mu:        sync.Mutex{},
+		padding:   padding,
 	}
+	hs := newUnstartedServer(http.HandlerFunc(srv.serveHTTP))
+	hs.Config.ConnState = srv.inspector.ConnState
+	hs.Listener = listener
+	hs.TLS = config
+	hs.EnableHTTP2 = true
+	hs.StartTLS()
+	srv.srv = hs
 	return srv
 }
 
@@ -59,6 +91,24 @@ type HTTPSServer struct {
 	// address is the address to use.
 	address string
 
+	// fault is the OPTIONAL fault to inject.
+	fault HTTPSFault
+
+	// handler is the handler serving DoH.
+	handler HTTPSHandler
+
+	// inspector writes the key log and records the TLS state.
+	inspector *tlsInspector
+
+	// listener is the listener injecting handshake faults.
+	listener *tlsFaultListener
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// padding pads the responses and records the query padding.
+	padding *paddingHandler
+
 	// srv is the HTTPS server.
 	srv *httptest.Server
 }
@@ -73,9 +123,82 @@ func (srv *HTTPSServer) Close() {
 	srv.srv.Close()
 }
 
+// SetFault sets the [HTTPSFault] to inject when serving requests.
+//
+// Use nil to stop injecting faults and serve requests normally.
+//
+// This method is safe to call while the server is running.
+func (srv *HTTPSServer) SetFault(fault HTTPSFault) {
+	srv.mu.Lock()
+	srv.fault = fault
+	srv.mu.Unlock()
+}
+
+// SetHandshakeFault sets the [TLSHandshakeFault] to inject for new connections.
+//
+// This method is safe to call while the server is running.
+func (srv *HTTPSServer) SetHandshakeFault(fault TLSHandshakeFault) {
+	srv.listener.SetFault(fault)
+}
+
+// SetKeyLogWriter sets the [io.Writer] where to write the TLS key log using
+// the NSS key log format, which allows to decrypt the traffic using, e.g.,
+// Wireshark. Use nil to stop writing the key log.
+//
+// This method is safe to call while the server is running.
+func (srv *HTTPSServer) SetKeyLogWriter(w io.Writer) {
+	srv.inspector.SetKeyLogWriter(w)
+}
+
+// ConnectionStates returns the [tls.ConnectionState] of each connection, in
+// the order in which the connections sent their first request, which allows
+// to inspect the negotiated version, cipher suite, ALPN, resumption, and SNI.
+//
+// We only record the connections whose handshake completed successfully and
+// that sent at least a request, which excludes, e.g., the ones rejected by
+// the client, and we only keep the 1024 most recent states.
+func (srv *HTTPSServer) ConnectionStates() []tls.ConnectionState {
+	return srv.inspector.ConnectionStates()
+}
+
+// PaddingLengths returns the length of the EDNS0 padding option (see RFC 7830)
+// of each query including such an option, in the order in which we received
+// the queries. We only keep the 1024 most recent lengths.
+func (srv *HTTPSServer) PaddingLengths() []int {
+	return srv.padding.PaddingLengths()
+}
+
+// serveHTTP serves HTTP requests injecting faults if needed.
+func (srv *HTTPSServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	fault := srv.fault
+	srv.mu.Unlock()
+	if fault == nil {
+		srv.handler.ServeHTTP(w, req)
+		return
+	}
+	fault(w, req, srv.handler)
+}
+
 // HTTPSHandler handles DoH requests.
+//
+// We support both POST requests and GET requests using the base64url encoded
+// query in the "dns" parameter (see RFC 8484 Sect. 4.1).
+//
+// We invoke the ServeDNS method of the DNSHandler field, if not nil, or
+// of the Handler field otherwise, using a synthetic [dns.ResponseWriter]
+// whose RemoteAddr method returns the address of the HTTP client. When both
+// fields are nil, we respond with 500 Internal Server Error.
+//
+// Because HTTPSHandler has more than one field, use keyed literals, e.g.,
+// HTTPSHandler{Handler: handler}, to initialize it.
 type HTTPSHandler struct {
+	// Handler is the [*Handler] to use when DNSHandler is nil.
 	Handler *Handler
+
+	// DNSHandler is the OPTIONAL [dns.Handler] to use, which may
+	// be any handler, including wrappers around [*Handler].
+	DNSHandler dns.Handler
 }
 
 // Ensure that [HTTPSHandler] implements [http.Handler].
@@ -83,18 +206,139 @@ var _ http.Handler = HTTPSHandler{}
 
 // ServeHTTP implements [http.Handler].
 func (hh HTTPSHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	handler := hh.dnsHandler()
+	if handler == nil {
+		// There is no handler to answer the query, which is a
+		// configuration error rather than a malformed request.
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			w.WriteHeader(http.StatusBadRequest)
 		}
 	}()
-	runtimex.Assert(req.Method == "POST")
-	runtimex.Assert(req.Header.Get("content-type") == "application/dns-message")
-	rawQuery := runtimex.PanicOnError1(io.ReadAll(req.Body))
+	var rawQuery []byte
+	switch req.Method {
+	case http.MethodGet:
+		rawQuery = runtimex.PanicOnError1(base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns")))
+	default:
+		runtimex.Assert(req.Method == http.MethodPost)
+		runtimex.Assert(req.Header.Get("content-type") == "application/dns-message")
+		rawQuery = runtimex.PanicOnError1(io.ReadAll(req.Body))
+	}
 	query := &dns.Msg{}
 	runtimex.PanicOnError0(query.Unpack(rawQuery))
-	resp := hh.Handler.PrepareResponse(query)
-	rawResp := runtimex.PanicOnError1(resp.Pack())
+	rw := newHTTPSResponseWriter(req)
+	handler.ServeDNS(rw, query)
+	if rw.rawResp == nil {
+		// The handler did not write any response (e.g., to simulate a
+		// timeout), so there is no DNS message to send back.
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("content-type", "application/dns-message")
-	w.Write(rawResp)
+	w.Write(rw.rawResp)
+}
+
+// dnsHandler returns the [dns.Handler] to use or nil when both fields are nil.
+func (hh HTTPSHandler) dnsHandler() dns.Handler {
+	switch {
+	case hh.DNSHandler != nil:
+		return hh.DNSHandler
+	case hh.Handler != nil:
+		return hh.Handler
+	default:
+		return nil
+	}
+}
+
+// httpsResponseWriter is the [dns.ResponseWriter] used by [HTTPSHandler].
+//
+// It also implements [dns.ConnectionStater].
+type httpsResponseWriter struct {
+	// connState is the OPTIONAL TLS connection state.
+	connState *tls.ConnectionState
+
+	// localAddr is the server address.
+	localAddr net.Addr
+
+	// rawResp contains the response written by the handler.
+	rawResp []byte
+
+	// remoteAddr is the client address.
+	remoteAddr net.Addr
+}
+
+// newHTTPSResponseWriter creates a new [*httpsResponseWriter] for the given request.
+func newHTTPSResponseWriter(req *http.Request) *httpsResponseWriter {
+	rw := &httpsResponseWriter{
+		connState:  req.TLS,
+		localAddr:  &net.TCPAddr{},
+		remoteAddr: &net.TCPAddr{},
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.localAddr = addr
+	}
+	if addrport, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		rw.remoteAddr = net.TCPAddrFromAddrPort(addrport)
+	}
+	return rw
+}
+
+// Ensure that [*httpsResponseWriter] implements [dns.ResponseWriter].
+var _ dns.ResponseWriter = &httpsResponseWriter{}
+
+// Ensure that [*httpsResponseWriter] implements [dns.ConnectionStater].
+var _ dns.ConnectionStater = &httpsResponseWriter{}
+
+// ConnectionState implements [dns.ConnectionStater].
+func (rw *httpsResponseWriter) ConnectionState() *tls.ConnectionState {
+	return rw.connState
+}
+
+// LocalAddr implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) LocalAddr() net.Addr {
+	return rw.localAddr
+}
+
+// RemoteAddr implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) RemoteAddr() net.Addr {
+	return rw.remoteAddr
+}
+
+// WriteMsg implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) WriteMsg(msg *dns.Msg) error {
+	rawResp, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = rw.Write(rawResp)
+	return err
+}
+
+// Write implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) Write(rawResp []byte) (int, error) {
+	rw.rawResp = append([]byte{}, rawResp...)
+	return len(rawResp), nil
+}
+
+// Close implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) Close() error {
+	return nil
+}
+
+// TsigStatus implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) TsigStatus() error {
+	return nil
+}
+
+// TsigTimersOnly implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) TsigTimersOnly(bool) {
+	// nothing
+}
+
+// Hijack implements [dns.ResponseWriter].
+func (rw *httpsResponseWriter) Hijack() {
+	// nothing
 }
@@ -5,9 +5,11 @@ package dnstest
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"testing"
 
@@ -34,7 +36,7 @@ func TestHTTPSInvalidRequest(t *testing.T) {
 	srv := MustNewHTTPSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, handler)
 	defer srv.Close()
 
-	// create HTTP request with GET method
+	// create HTTP request with GET method and without the dns parameter
 	httpReq := runtimex.PanicOnError1(http.NewRequest("GET", srv.URL(), nil))
 	httpReq.Header.Set("content-type", "application/dns-message")
 
@@ -145,3 +147,220 @@ func TestHTTPSWorks(t *testing.T) {
 	expect := []string{"104.20.34.220", "172.66.144.113"}
 	assert.Equal(t, expect, addrs)
 }
+
+func TestHTTPSCustomHandler(t *testing.T) {
+	// create a custom handler wrapping the default handler
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	var remoteAddr net.Addr
+	handler := dns.HandlerFunc(func(rw dns.ResponseWriter, query *dns.Msg) {
+		remoteAddr = rw.RemoteAddr()
+		NewHandler(config).ServeDNS(rw, query)
+	})
+
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create server
+	srv := MustNewHTTPSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, handler)
+	defer srv.Close()
+
+	// create HTTP request containing query
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	rawQuery := runtimex.PanicOnError1(query.Pack())
+	httpReq := runtimex.PanicOnError1(http.NewRequest("POST", srv.URL(), bytes.NewReader(rawQuery)))
+	httpReq.Header.Set("content-type", "application/dns-message")
+
+	// setup HTTPS client
+	tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+	tdialer := &tls.Dialer{NetDialer: &net.Dialer{}, Config: tlsCfg}
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: tdialer.DialContext}}
+
+	// get response body
+	httpResp, err := client.Do(httpReq)
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.True(t, httpResp.StatusCode == http.StatusOK)
+	rawResp, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+
+	// parse response body
+	resp := &dns.Msg{}
+	err = resp.Unpack(rawResp)
+	assert.NoError(t, err)
+
+	// get results
+	addrs := collectAddrs(resp)
+	expect := []string{"104.20.34.220"}
+	assert.Equal(t, expect, addrs)
+
+	// make sure the handler saw the client address
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", tcpAddr.IP.String())
+	assert.True(t, tcpAddr.Port != 0)
+}
+
+func TestHTTPSHandlerNoResponse(t *testing.T) {
+	// create a handler that never writes a response
+	handler := dns.HandlerFunc(func(rw dns.ResponseWriter, query *dns.Msg) {
+		// nothing
+	})
+
+	// create HTTP request containing query
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	rawQuery := runtimex.PanicOnError1(query.Pack())
+	httpReq := httptest.NewRequest("POST", "/", bytes.NewReader(rawQuery))
+	httpReq.Header.Set("content-type", "application/dns-message")
+
+	// serve the request
+	rr := httptest.NewRecorder()
+	HTTPSHandler{DNSHandler: handler}.ServeHTTP(rr, httpReq)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
+func TestHTTPSWithConfig(t *testing.T) {
+	// create config
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+
+	// create handler
+	handler := NewHandler(config)
+
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create a TLS 1.2-only server only speaking HTTP/1.1
+	srv := MustNewHTTPSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}, handler)
+	defer srv.Close()
+
+	// create HTTP request containing query
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	rawQuery := runtimex.PanicOnError1(query.Pack())
+	httpReq := runtimex.PanicOnError1(http.NewRequest("POST", srv.URL(), bytes.NewReader(rawQuery)))
+	httpReq.Header.Set("content-type", "application/dns-message")
+
+	// setup HTTPS client
+	tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   tlsCfg,
+		ForceAttemptHTTP2: true,
+	}}
+
+	// get response body
+	httpResp, err := client.Do(httpReq)
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.True(t, httpResp.StatusCode == http.StatusOK)
+	assert.Equal(t, "HTTP/1.1", httpResp.Proto)
+	assert.Equal(t, uint16(tls.VersionTLS12), httpResp.TLS.Version)
+	rawResp, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+
+	// parse response body
+	resp := &dns.Msg{}
+	err = resp.Unpack(rawResp)
+	assert.NoError(t, err)
+
+	// get results
+	addrs := collectAddrs(resp)
+	expect := []string{"104.20.34.220"}
+	assert.Equal(t, expect, addrs)
+}
+
+func TestHTTPSHandlerFields(t *testing.T) {
+	// create a *Handler and a dns.Handler answering differently
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	legacy := NewHandler(config)
+	custom := dns.HandlerFunc(func(rw dns.ResponseWriter, query *dns.Msg) {
+		resp := &dns.Msg{}
+		resp.SetRcode(query, dns.RcodeRefused)
+		rw.WriteMsg(resp)
+	})
+
+	// serve returns the rcode of the response served by the given HTTPSHandler.
+	serve := func(hh HTTPSHandler) int {
+		query := &dns.Msg{}
+		query.SetQuestion("www.example.com.", dns.TypeA)
+		rawQuery := runtimex.PanicOnError1(query.Pack())
+		httpReq := httptest.NewRequest("POST", "/", bytes.NewReader(rawQuery))
+		httpReq.Header.Set("content-type", "application/dns-message")
+		rr := httptest.NewRecorder()
+		hh.ServeHTTP(rr, httpReq)
+		resp := &dns.Msg{}
+		assert.NoError(t, resp.Unpack(rr.Body.Bytes()))
+		return resp.Rcode
+	}
+
+	// the Handler field keeps working and DNSHandler takes precedence
+	assert.Equal(t, dns.RcodeSuccess, serve(HTTPSHandler{Handler: legacy}))
+	assert.Equal(t, dns.RcodeRefused, serve(HTTPSHandler{DNSHandler: custom}))
+	assert.Equal(t, dns.RcodeRefused, serve(HTTPSHandler{Handler: legacy, DNSHandler: custom}))
+}
+
+func TestHTTPSHandlerWithoutHandlers(t *testing.T) {
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	rawQuery := runtimex.PanicOnError1(query.Pack())
+	httpReq := httptest.NewRequest("POST", "/", bytes.NewReader(rawQuery))
+	httpReq.Header.Set("content-type", "application/dns-message")
+	rr := httptest.NewRecorder()
+	HTTPSHandler{}.ServeHTTP(rr, httpReq)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Empty(t, rr.Body.Bytes())
+}
+
+func TestHTTPSHandlerGET(t *testing.T) {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	hh := HTTPSHandler{Handler: NewHandler(config)}
+
+	t.Run("with a valid dns parameter", func(t *testing.T) {
+		query := &dns.Msg{}
+		query.SetQuestion("www.example.com.", dns.TypeA)
+		encoded := base64.RawURLEncoding.EncodeToString(runtimex.PanicOnError1(query.Pack()))
+		rr := httptest.NewRecorder()
+		hh.ServeHTTP(rr, httptest.NewRequest("GET", "/dns-query?dns="+encoded, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "application/dns-message", rr.Header().Get("content-type"))
+		resp := &dns.Msg{}
+		assert.NoError(t, resp.Unpack(rr.Body.Bytes()))
+		assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	})
+
+	t.Run("with an invalid dns parameter", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		hh.ServeHTTP(rr, httptest.NewRequest("GET", "/dns-query?dns=%3D%3D", nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
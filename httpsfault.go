@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/bassosimone/runtimex"
+)
+
+// HTTPSFault is an HTTP-level fault injected by [*HTTPSServer].
+//
+// The fault receives the HTTP request along with the next [http.Handler],
+// which serves DoH using [HTTPSHandler], and decides whether and how to
+// invoke it. Use [*HTTPSServer.SetFault] to enable a fault.
+//
+// Construct using the HTTPSFault* functions or write your own.
+type HTTPSFault func(w http.ResponseWriter, req *http.Request, next http.Handler)
+
+// HTTPSFaultStatus returns an [HTTPSFault] that replies with the given
+// HTTP status code (e.g., 503 or 429) without serving the query.
+//
+// When retryAfter is not empty, we also send a Retry-After header containing
+// its value, which could either be a number of seconds or an HTTP date.
+//
+// This function PANICS if the status code is not within 100 and 599.
+func HTTPSFaultStatus(statusCode int, retryAfter string) HTTPSFault {
+	runtimex.Assert(100 <= statusCode && statusCode <= 599)
+	return func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		if retryAfter != "" {
+			w.Header().Set("retry-after", retryAfter)
+		}
+		w.WriteHeader(statusCode)
+	}
+}
+
+// HTTPSFaultContentType returns an [HTTPSFault] that serves the query
+// but replaces the response content-type with the given value.
+func HTTPSFaultContentType(contentType string) HTTPSFault {
+	return func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		rec := httpsFaultRecord(req, next)
+		rec.Header().Set("content-type", contentType)
+		httpsFaultReplay(w, rec)
+	}
+}
+
+// httpsFaultRedirectParam is the URL query parameter used by [HTTPSFaultRedirect]
+// to count the number of redirects in the chain.
+const httpsFaultRedirectParam = "dnstest-redirects"
+
+// HTTPSFaultRedirect returns an [HTTPSFault] that redirects the client, using
+// 307 Temporary Redirect, count times before serving the query.
+//
+// Each redirect points to the same path with an updated query string,
+// so the client must preserve the method and body across redirects. Using
+// a count larger than the client's redirect limit emulates a loop.
+func HTTPSFaultRedirect(count int) HTTPSFault {
+	return func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		values := req.URL.Query()
+		seen, _ := strconv.Atoi(values.Get(httpsFaultRedirectParam))
+		if seen >= count {
+			next.ServeHTTP(w, req)
+			return
+		}
+		values.Set(httpsFaultRedirectParam, strconv.Itoa(seen+1))
+		location := *req.URL
+		location.RawQuery = values.Encode()
+		http.Redirect(w, req, location.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+// HTTPSFaultStallBody returns an [HTTPSFault] that sends the headers along
+// with the first half of the response body and then stalls for the given
+// duration, or until the client goes away, before sending the rest.
+//
+// We do not send a content-length, hence the body is chunked when
+// using HTTP/1.1 and streamed using DATA frames when using HTTP/2.
+func HTTPSFaultStallBody(stall time.Duration) HTTPSFault {
+	return func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		rec := httpsFaultRecord(req, next)
+		body := rec.Body.Bytes()
+		copyHeader(w.Header(), rec.Header())
+		w.WriteHeader(rec.Code)
+		w.Write(body[:len(body)/2])
+		http.NewResponseController(w).Flush()
+		select {
+		case <-time.After(stall):
+		case <-req.Context().Done():
+			return
+		}
+		w.Write(body[len(body)/2:])
+	}
+}
+
+// HTTPSFaultGoAway returns an [HTTPSFault] that serves the query and then
+// tears down the connection. With HTTP/2, this causes the server to send
+// a GOAWAY frame. With HTTP/1.1, the server closes the connection after
+// sending the response.
+func HTTPSFaultGoAway() HTTPSFault {
+	return func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		w.Header().Set("connection", "close")
+		next.ServeHTTP(w, req)
+	}
+}
+
+// HTTPSFaultCloseAfterHeaders returns an [HTTPSFault] that sends the response
+// headers, including a content-length, and then aborts without sending the
+// body. With HTTP/1.1, this closes the connection. With HTTP/2, this resets
+// the stream carrying the response.
+func HTTPSFaultCloseAfterHeaders() HTTPSFault {
+	return func(w http.ResponseWriter, req *http.Request, next http.Handler) {
+		rec := httpsFaultRecord(req, next)
+		copyHeader(w.Header(), rec.Header())
+		w.Header().Set("content-length", strconv.Itoa(rec.Body.Len()))
+		w.WriteHeader(rec.Code)
+		http.NewResponseController(w).Flush()
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// httpsFaultRecord serves the request using next and records the response.
+func httpsFaultRecord(req *http.Request, next http.Handler) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	next.ServeHTTP(rec, req)
+	return rec
+}
+
+// httpsFaultReplay writes a recorded response to the given writer.
+func httpsFaultReplay(w http.ResponseWriter, rec *httptest.ResponseRecorder) {
+	copyHeader(w.Header(), rec.Header())
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+// copyHeader copies all the headers in source into dest.
+func copyHeader(dest, source http.Header) {
+	for key, values := range source {
+		dest[key] = append([]string{}, values...)
+	}
+}
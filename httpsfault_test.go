@@ -0,0 +1,217 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newHTTPSFaultTestServer creates an [*HTTPSServer] along with an HTTP/2
+// capable [*http.Client] configured to trust the server certificate.
+func newHTTPSFaultTestServer() (*HTTPSServer, *http.Client) {
+	// create config and handler
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	handler := NewHandler(config)
+
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create server
+	srv := MustNewHTTPSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, handler)
+
+	// setup HTTPS client
+	tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   tlsCfg,
+		ForceAttemptHTTP2: true,
+	}}
+	return srv, client
+}
+
+// newHTTPSFaultTestRequest creates a DoH request for www.example.com.
+func newHTTPSFaultTestRequest(URL string) *http.Request {
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	rawQuery := runtimex.PanicOnError1(query.Pack())
+	httpReq := runtimex.PanicOnError1(http.NewRequest("POST", URL, bytes.NewReader(rawQuery)))
+	httpReq.Header.Set("content-type", "application/dns-message")
+	return httpReq
+}
+
+// parseHTTPSFaultTestResponse parses the DNS response body and returns the addresses.
+func parseHTTPSFaultTestResponse(t *testing.T, rawResp []byte) []string {
+	resp := &dns.Msg{}
+	err := resp.Unpack(rawResp)
+	assert.NoError(t, err)
+	return collectAddrs(resp)
+}
+
+func TestHTTPSFaultStatus(t *testing.T) {
+	srv, client := newHTTPSFaultTestServer()
+	defer srv.Close()
+	srv.SetFault(HTTPSFaultStatus(http.StatusTooManyRequests, "30"))
+
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, "30", httpResp.Header.Get("retry-after"))
+}
+
+func TestHTTPSFaultStatusPanics(t *testing.T) {
+	for _, statusCode := range []int{0, 99, 600} {
+		assert.Panics(t, func() { HTTPSFaultStatus(statusCode, "") })
+	}
+	assert.NotPanics(t, func() { HTTPSFaultStatus(100, "") })
+	assert.NotPanics(t, func() { HTTPSFaultStatus(599, "") })
+}
+
+func TestHTTPSFaultContentType(t *testing.T) {
+	srv, client := newHTTPSFaultTestServer()
+	defer srv.Close()
+	srv.SetFault(HTTPSFaultContentType("text/html"))
+
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, "text/html", httpResp.Header.Get("content-type"))
+	rawResp, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"104.20.34.220"}, parseHTTPSFaultTestResponse(t, rawResp))
+}
+
+func TestHTTPSFaultRedirect(t *testing.T) {
+	t.Run("with a short chain", func(t *testing.T) {
+		srv, client := newHTTPSFaultTestServer()
+		defer srv.Close()
+		srv.SetFault(HTTPSFaultRedirect(3))
+
+		httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+		assert.NoError(t, err)
+		defer httpResp.Body.Close()
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.True(t, strings.HasSuffix(httpResp.Request.URL.String(), "?dnstest-redirects=3"))
+		rawResp, err := io.ReadAll(httpResp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"104.20.34.220"}, parseHTTPSFaultTestResponse(t, rawResp))
+	})
+
+	t.Run("with a chain longer than the client limit", func(t *testing.T) {
+		srv, client := newHTTPSFaultTestServer()
+		defer srv.Close()
+		srv.SetFault(HTTPSFaultRedirect(100))
+
+		_, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+		assert.ErrorContains(t, err, "stopped after 10 redirects")
+	})
+}
+
+func TestHTTPSFaultStallBody(t *testing.T) {
+	t.Run("when the client waits", func(t *testing.T) {
+		srv, client := newHTTPSFaultTestServer()
+		defer srv.Close()
+		const stall = 250 * time.Millisecond
+		srv.SetFault(HTTPSFaultStallBody(stall))
+
+		t0 := time.Now()
+		httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+		assert.NoError(t, err)
+		defer httpResp.Body.Close()
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		rawResp, err := io.ReadAll(httpResp.Body)
+		assert.NoError(t, err)
+		assert.True(t, time.Since(t0) >= stall)
+		assert.Equal(t, []string{"104.20.34.220"}, parseHTTPSFaultTestResponse(t, rawResp))
+	})
+
+	t.Run("when the client times out", func(t *testing.T) {
+		srv, client := newHTTPSFaultTestServer()
+		defer srv.Close()
+		srv.SetFault(HTTPSFaultStallBody(time.Hour))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()).WithContext(ctx))
+		assert.NoError(t, err)
+		defer httpResp.Body.Close()
+		_, err = io.ReadAll(httpResp.Body)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestHTTPSFaultGoAway(t *testing.T) {
+	srv, client := newHTTPSFaultTestServer()
+	defer srv.Close()
+	srv.SetFault(HTTPSFaultGoAway())
+
+	// perform two round trips and record whether the connection was reused
+	var reused []bool
+	for range 2 {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				reused = append(reused, info.Reused)
+			},
+		}
+		httpReq := newHTTPSFaultTestRequest(srv.URL())
+		httpReq = httpReq.WithContext(httptrace.WithClientTrace(httpReq.Context(), trace))
+		httpResp, err := client.Do(httpReq)
+		assert.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", httpResp.Proto)
+		rawResp, err := io.ReadAll(httpResp.Body)
+		assert.NoError(t, err)
+		httpResp.Body.Close()
+		assert.Equal(t, []string{"104.20.34.220"}, parseHTTPSFaultTestResponse(t, rawResp))
+	}
+	assert.Equal(t, []bool{false, false}, reused)
+}
+
+func TestHTTPSFaultCloseAfterHeaders(t *testing.T) {
+	srv, client := newHTTPSFaultTestServer()
+	defer srv.Close()
+	srv.SetFault(HTTPSFaultCloseAfterHeaders())
+
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	_, err = io.ReadAll(httpResp.Body)
+	assert.Error(t, err)
+}
+
+func TestHTTPSServerSetFaultNil(t *testing.T) {
+	srv, client := newHTTPSFaultTestServer()
+	defer srv.Close()
+	srv.SetFault(HTTPSFaultStatus(http.StatusServiceUnavailable, ""))
+	srv.SetFault(nil)
+
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// TLSClientAuth is the client authentication mode used by [NewMutualTLSConfig].
+type TLSClientAuth int
+
+const (
+	// TLSClientAuthRequest requests a client certificate but does
+	// neither require the client to send it nor verify it.
+	TLSClientAuthRequest = TLSClientAuth(iota + 1)
+
+	// TLSClientAuthRequire requires a client certificate but
+	// does not verify it against a certificate pool.
+	TLSClientAuthRequire
+
+	// TLSClientAuthVerify requires a client certificate and
+	// verifies it against a certificate pool.
+	TLSClientAuthVerify
+)
+
+// NewMutualTLSConfig returns a [*tls.Config] for [MustNewTLSServerWithConfig]
+// and [MustNewHTTPSServerWithConfig] using the given server certificate
+// and requesting client certificates according to the given mode.
+//
+// With [TLSClientAuthVerify], we verify client certificates against the given
+// pool, which is typically the [*pkitest.PKI] CertPool. Because pkitest
+// certificates are only valid for server authentication, we do not check
+// the extended key usage. The pool is ignored by the other modes.
+//
+// Handlers can obtain the client certificate using [ClientCertificate]. Tests
+// can inspect the client certificate of each connection using the
+// PeerCertificates field of the states returned by the ConnectionStates
+// method of [*TLSServer] and [*HTTPSServer].
+//
+// This function PANICS if the mode is unknown or if the mode is
+// [TLSClientAuthVerify] and the pool is nil, since a nil pool would
+// cause us to verify client certificates using the system roots.
+func NewMutualTLSConfig(cert tls.Certificate, mode TLSClientAuth, pool *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	switch mode {
+	case TLSClientAuthRequest:
+		config.ClientAuth = tls.RequestClientCert
+
+	case TLSClientAuthRequire:
+		config.ClientAuth = tls.RequireAnyClientCert
+
+	case TLSClientAuthVerify:
+		runtimex.Assert(pool != nil)
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.ClientCAs = pool
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyClientCertificate(rawCerts, pool)
+		}
+
+	default:
+		panic("dnstest: unknown TLSClientAuth")
+	}
+	return config
+}
+
+// errNoClientCertificate indicates that the client did not send a certificate.
+var errNoClientCertificate = errors.New("dnstest: no client certificate")
+
+// verifyClientCertificate verifies the client certificate chain against the given pool.
+func verifyClientCertificate(rawCerts [][]byte, pool *x509.CertPool) error {
+	if len(rawCerts) <= 0 {
+		return errNoClientCertificate
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		Roots:         pool,
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// ClientCertificate returns the certificate the client used to authenticate
+// with [*TLSServer] or [*HTTPSServer], or nil if there is no such certificate.
+//
+// When the server uses [TLSClientAuthVerify], the returned certificate
+// has been verified during the TLS handshake.
+//
+// See also [*TLSServer.ConnectionStates] and [*HTTPSServer.ConnectionStates],
+// which record the client certificates of all the connections.
+func ClientCertificate(rw dns.ResponseWriter) *x509.Certificate {
+	stater, ok := rw.(dns.ConnectionStater)
+	if !ok {
+		return nil
+	}
+	state := stater.ConnectionState()
+	if state == nil || len(state.PeerCertificates) <= 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMutualTLSTestHandler returns a handler that records the client certificate
+// common name before delegating to the default [*Handler].
+func newMutualTLSTestHandler(commonName *string) dns.Handler {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	return dns.HandlerFunc(func(rw dns.ResponseWriter, query *dns.Msg) {
+		if cert := ClientCertificate(rw); cert != nil {
+			*commonName = cert.Subject.CommonName
+		}
+		NewHandler(config).ServeDNS(rw, query)
+	})
+}
+
+// exchangeMutualTLSTest performs a DoT exchange for www.example.com.
+func exchangeMutualTLSTest(address string, tlsCfg *tls.Config) (*dns.Msg, error) {
+	conn, err := tls.Dial("tcp", address, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	dconn := &dns.Conn{Conn: conn}
+	if err := dconn.WriteMsg(query); err != nil {
+		return nil, err
+	}
+	return dconn.ReadMsg()
+}
+
+func TestMutualTLSWithTLSServer(t *testing.T) {
+	// create pki along with the server and client certificates
+	pki := pkitest.MustNewPKI("testdata")
+	serverCert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+	clientCert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "client.example.com",
+		DNSNames:     []string{"client.example.com"},
+		Organization: []string{"Example"},
+	})
+	untrusted := pkitest.MustNewSelfSignedCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "untrusted.example.com",
+		DNSNames:     []string{"untrusted.example.com"},
+		Organization: []string{"Example"},
+	})
+	untrustedCert := runtimex.PanicOnError1(tls.X509KeyPair(untrusted.CertPEM, untrusted.KeyPEM))
+
+	type testCase struct {
+		name         string
+		mode         TLSClientAuth
+		certs        []tls.Certificate
+		expectErr    bool
+		expectClient string
+	}
+
+	testCases := []testCase{
+		{
+			name:         "request without certificate",
+			mode:         TLSClientAuthRequest,
+			certs:        nil,
+			expectErr:    false,
+			expectClient: "",
+		},
+
+		{
+			name:         "request with certificate",
+			mode:         TLSClientAuthRequest,
+			certs:        []tls.Certificate{clientCert},
+			expectErr:    false,
+			expectClient: "client.example.com",
+		},
+
+		{
+			name:         "require without certificate",
+			mode:         TLSClientAuthRequire,
+			certs:        nil,
+			expectErr:    true,
+			expectClient: "",
+		},
+
+		{
+			name:         "require with untrusted certificate",
+			mode:         TLSClientAuthRequire,
+			certs:        []tls.Certificate{untrustedCert},
+			expectErr:    false,
+			expectClient: "untrusted.example.com",
+		},
+
+		{
+			name:         "verify with trusted certificate",
+			mode:         TLSClientAuthVerify,
+			certs:        []tls.Certificate{clientCert},
+			expectErr:    false,
+			expectClient: "client.example.com",
+		},
+
+		{
+			name:         "verify with untrusted certificate",
+			mode:         TLSClientAuthVerify,
+			certs:        []tls.Certificate{untrustedCert},
+			expectErr:    true,
+			expectClient: "",
+		},
+
+		{
+			name:         "verify without certificate",
+			mode:         TLSClientAuthVerify,
+			certs:        nil,
+			expectErr:    true,
+			expectClient: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// create server
+			var commonName string
+			config := NewMutualTLSConfig(serverCert, tc.mode, pki.CertPool())
+			handler := newMutualTLSTestHandler(&commonName)
+			srv := MustNewTLSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", config, handler)
+			defer srv.Close()
+
+			// exchange
+			tlsCfg := &tls.Config{
+				Certificates: tc.certs,
+				RootCAs:      pki.CertPool(),
+				ServerName:   "dns.example.com",
+			}
+			resp, err := exchangeMutualTLSTest(srv.Address(), tlsCfg)
+
+			// check results
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+			assert.Equal(t, tc.expectClient, commonName)
+
+			// the recorded connection state contains the same client identity
+			states := srv.ConnectionStates()
+			assert.Len(t, states, 1)
+			var recorded string
+			if len(states[0].PeerCertificates) > 0 {
+				recorded = states[0].PeerCertificates[0].Subject.CommonName
+			}
+			assert.Equal(t, tc.expectClient, recorded)
+		})
+	}
+}
+
+func TestMutualTLSWithHTTPSServer(t *testing.T) {
+	// create pki along with the server and client certificates
+	pki := pkitest.MustNewPKI("testdata")
+	serverCert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+	clientCert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "client.example.com",
+		DNSNames:     []string{"client.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create server
+	var commonName string
+	config := NewMutualTLSConfig(serverCert, TLSClientAuthVerify, pki.CertPool())
+	handler := newMutualTLSTestHandler(&commonName)
+	srv := MustNewHTTPSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", config, handler)
+	defer srv.Close()
+
+	// create HTTP request containing query
+	query := &dns.Msg{}
+	query.Question = append(query.Question, dns.Question{
+		Name:   dns.CanonicalName("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	})
+	rawQuery := runtimex.PanicOnError1(query.Pack())
+	httpReq := runtimex.PanicOnError1(http.NewRequest("POST", srv.URL(), bytes.NewReader(rawQuery)))
+	httpReq.Header.Set("content-type", "application/dns-message")
+
+	// setup HTTPS client using a client certificate
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pki.CertPool(),
+		ServerName:   "dns.example.com",
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+	// get response body
+	httpResp, err := client.Do(httpReq)
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.True(t, httpResp.StatusCode == http.StatusOK)
+	rawResp, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+
+	// parse response body
+	resp := &dns.Msg{}
+	err = resp.Unpack(rawResp)
+	assert.NoError(t, err)
+
+	// check results
+	assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	assert.Equal(t, "client.example.com", commonName)
+
+	// the recorded connection state contains the verified client identity
+	states := srv.ConnectionStates()
+	assert.Len(t, states, 1)
+	assert.Equal(t, "client.example.com", states[0].PeerCertificates[0].Subject.CommonName)
+}
+
+func TestClientCertificateWithoutTLS(t *testing.T) {
+	assert.Nil(t, ClientCertificate(&httpsResponseWriter{}))
+}
+
+func TestVerifyClientCertificateInvalidCert(t *testing.T) {
+	err := verifyClientCertificate([][]byte{[]byte("invalid")}, x509.NewCertPool())
+	assert.Error(t, err)
+}
+
+func TestNewMutualTLSConfigPanics(t *testing.T) {
+	type testCase struct {
+		name string
+		mode TLSClientAuth
+		pool *x509.CertPool
+	}
+
+	testCases := []testCase{
+		{
+			name: "zero value mode",
+			mode: 0,
+			pool: x509.NewCertPool(),
+		},
+
+		{
+			name: "unknown mode",
+			mode: TLSClientAuthVerify + 1,
+			pool: x509.NewCertPool(),
+		},
+
+		{
+			name: "verify with nil pool",
+			mode: TLSClientAuthVerify,
+			pool: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Panics(t, func() {
+				NewMutualTLSConfig(tls.Certificate{}, tc.mode, tc.pool)
+			})
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// NSEC3Params contains the NSEC3 parameters of a [*SignedZone] (see RFC 5155).
+//
+// Use with [*HandlerConfig.SignZoneWithNSEC3].
+type NSEC3Params struct {
+	// Iterations is the number of additional hash iterations.
+	Iterations uint16
+
+	// OptOut sets the opt-out flag of the NSEC3 records.
+	OptOut bool
+
+	// Salt is the hex-encoded salt or empty for no salt.
+	Salt string
+}
+
+// newNSEC3PARAM returns the NSEC3PARAM record for the given zone apex.
+//
+// This method PANICS if the salt is invalid.
+func (p *NSEC3Params) newNSEC3PARAM(zone string) *dns.NSEC3PARAM {
+	salt := runtimex.PanicOnError1(hex.DecodeString(p.Salt))
+	runtimex.Assert(len(salt) <= 255)
+	return &dns.NSEC3PARAM{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeNSEC3PARAM,
+			Class:  dns.ClassINET,
+			Ttl:    handlerDefaultTTL,
+		},
+		Hash:       dns.SHA1,
+		Iterations: p.Iterations,
+		SaltLength: uint8(len(salt)),
+		Salt:       strings.ToUpper(p.Salt),
+	}
+}
+
+// negativeCNAMEs returns the CNAMEs leading to the given target to include
+// into a negative answer, which we only keep when the target belongs to a
+// signed zone, since the denial of existence refers to the target.
+func (c *HandlerConfig) negativeCNAMEs(target string, cnames []dns.RR) []dns.RR {
+	if c.findZone(target, dns.TypeNone) == nil {
+		return nil
+	}
+	return cnames
+}
+
+// addDenial adds the denial of existence to a response from a signed zone.
+//
+// For negative answers, we add the SOA record to the authority section and,
+// when do is true, the NSEC or NSEC3 records proving that the name or the
+// type does not exist. For answers synthesized from a wildcard, when do is
+// true, we add the records proving that the name does not exist.
+func (c *HandlerConfig) addDenial(query, resp *dns.Msg, do bool) {
+	// 1. only consider successful answers and NXDOMAIN
+	if len(query.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	// 2. follow the CNAME chain to find the name we need to deny
+	qname, qtype := dns.CanonicalName(query.Question[0].Name), query.Question[0].Qtype
+	var answered bool
+	for _, rr := range resp.Answer {
+		if dns.CanonicalName(rr.Header().Name) != qname {
+			continue
+		}
+		if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+			qname = dns.CanonicalName(cname.Target)
+			continue
+		}
+		answered = answered || rr.Header().Rrtype == qtype
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 3. make sure the name belongs to a signed zone
+	sz := c.findZoneLocked(qname, qtype)
+	if sz == nil {
+		return
+	}
+
+	// 4. positive answers need a proof only when synthesized from a wildcard
+	wildcard, synthesized := c.wildcardLocked(qname)
+	if answered && !synthesized {
+		return
+	}
+
+	// 5. negative answers include the SOA record
+	if !answered {
+		for _, rr := range c.rrs[sz.name] {
+			if soa, ok := rr.(*dns.SOA); ok {
+				soa = dns.Copy(soa).(*dns.SOA)
+				soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+				resp.Ns = append(resp.Ns, soa)
+			}
+		}
+	}
+
+	// 6. add the records proving the denial of existence
+	if do {
+		resp.Ns = append(resp.Ns, c.denialProofLocked(sz, qname, wildcard, answered, synthesized)...)
+	}
+}
+
+// denialProofLocked returns the NSEC or NSEC3 records proving that the name
+// or the type does not exist, or that the name does not exist and we have
+// synthesized the answer from the given wildcard.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) denialProofLocked(
+	sz *SignedZone, qname, wildcard string, answered, synthesized bool) []dns.RR {
+	// 1. build the chain of the zone
+	var chain denialChain
+	switch sz.nsec3 {
+	case nil:
+		chain = newNSECChain(c.zoneNamesLocked(sz, false))
+	default:
+		chain = newNSEC3Chain(sz, c.zoneNamesLocked(sz, true))
+	}
+
+	// 2. find the closest encloser and the next closer name
+	encloser, nextCloser := c.closestEncloserLocked(qname), qname
+	if labels := dns.Split(qname); len(labels) > dns.CountLabel(encloser) {
+		nextCloser = qname[labels[len(labels)-dns.CountLabel(encloser)-1]:]
+	}
+	if !synthesized {
+		wildcard = "*." + strings.TrimPrefix(encloser, ".")
+	}
+
+	// 3. select the proof depending on the case (see RFC 4035 Sect. 3.1.3 and RFC 5155 Sect. 7.2)
+	var proof []dns.RR
+	switch {
+	// 3.1. the name exists but it does not have the type
+	case c.existsLocked(qname):
+		proof = append(proof, chain.match(qname))
+
+	// 3.2. the name does not exist and there is no wildcard
+	case !synthesized:
+		proof = append(proof, chain.closestEncloser(encloser, qname, nextCloser)...)
+		proof = append(proof, chain.cover(wildcard))
+
+	// 3.3. the answer was synthesized from the wildcard
+	case answered:
+		proof = append(proof, chain.nextCloser(qname, nextCloser))
+
+	// 3.4. the wildcard exists but it does not have the type
+	default:
+		proof = append(proof, chain.closestEncloser(encloser, qname, nextCloser)...)
+		proof = append(proof, chain.match(wildcard))
+	}
+
+	// 4. remove the duplicate records
+	var output []dns.RR
+	for _, rr := range proof {
+		if !slices.ContainsFunc(output, func(other dns.RR) bool {
+			return other.Header().Name == rr.Header().Name
+		}) {
+			output = append(output, rr)
+		}
+	}
+	return output
+}
+
+// zoneNamesLocked returns the names belonging to the given zone, including
+// the ones only having records for specific client subnets, mapped to the
+// sorted types we should include in the type bitmap. When ents is true, we
+// also include the empty non-terminals, which have no types.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) zoneNamesLocked(sz *SignedZone, ents bool) map[string][]uint16 {
+	names := map[string][]uint16{}
+	add := func(name string, rrtype uint16) {
+		// note: this excludes the DS at the apex and includes the DS of the child zones
+		if dns.IsSubDomain(sz.name, name) && c.findZoneLocked(name, rrtype) == sz &&
+			!slices.Contains(names[name], rrtype) {
+			names[name] = append(names[name], rrtype)
+		}
+	}
+	for name, records := range c.rrs {
+		for _, rr := range records {
+			add(name, rr.Header().Rrtype)
+		}
+	}
+	for name, entries := range c.subnets {
+		for _, entry := range entries {
+			add(name, entry.rr.Header().Rrtype)
+		}
+	}
+	for name := range names {
+		slices.Sort(names[name])
+		for ents && name != sz.name {
+			_, parent, _ := strings.Cut(name, ".")
+			name = dns.CanonicalName(parent)
+			if _, found := names[name]; !found {
+				names[name] = nil
+			}
+		}
+	}
+	return names
+}
+
+// denialChain is a chain of NSEC or NSEC3 records.
+type denialChain interface {
+	// closestEncloser returns the records proving the closest encloser of the
+	// given name along with the records proving that the next closer does not exist.
+	closestEncloser(encloser, name, nextCloser string) []dns.RR
+
+	// cover returns the record covering the given name.
+	cover(name string) dns.RR
+
+	// match returns the record matching the given name or, when there is no
+	// such record, the record covering the given name.
+	match(name string) dns.RR
+
+	// nextCloser returns the record proving that the next closer does not exist.
+	nextCloser(name, nextCloser string) dns.RR
+}
+
+// nsecChain is the [denialChain] using NSEC.
+type nsecChain struct {
+	// names contains the sorted owner names.
+	names []string
+
+	// types maps the owner names to their types.
+	types map[string][]uint16
+}
+
+// Ensure that [*nsecChain] implements [denialChain].
+var _ denialChain = &nsecChain{}
+
+// newNSECChain constructs a new [*nsecChain].
+func newNSECChain(names map[string][]uint16) *nsecChain {
+	chain := &nsecChain{types: names}
+	for name := range names {
+		chain.names = append(chain.names, name)
+	}
+	slices.SortFunc(chain.names, compareCanonicalNames)
+	return chain
+}
+
+// closestEncloser implements [denialChain].
+func (nc *nsecChain) closestEncloser(encloser, name, nextCloser string) []dns.RR {
+	// with NSEC, the record covering the name proves the closest encloser
+	return []dns.RR{nc.cover(name)}
+}
+
+// cover implements [denialChain].
+func (nc *nsecChain) cover(name string) dns.RR {
+	idx, _ := slices.BinarySearchFunc(nc.names, name, compareCanonicalNames)
+	return nc.record((idx - 1 + len(nc.names)) % len(nc.names))
+}
+
+// match implements [denialChain].
+func (nc *nsecChain) match(name string) dns.RR {
+	idx, found := slices.BinarySearchFunc(nc.names, name, compareCanonicalNames)
+	if !found {
+		return nc.cover(name)
+	}
+	return nc.record(idx)
+}
+
+// nextCloser implements [denialChain].
+func (nc *nsecChain) nextCloser(name, nextCloser string) dns.RR {
+	// with NSEC, we need to cover the name rather than the next closer
+	return nc.cover(name)
+}
+
+// record returns the NSEC record at the given index.
+func (nc *nsecChain) record(idx int) dns.RR {
+	owner := nc.names[idx]
+	types := append(slices.Clone(nc.types[owner]), dns.TypeRRSIG, dns.TypeNSEC)
+	slices.Sort(types)
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    signedZoneNegativeTTL,
+		},
+		NextDomain: nc.names[(idx+1)%len(nc.names)],
+		TypeBitMap: types,
+	}
+}
+
+// nsec3Chain is the [denialChain] using NSEC3.
+type nsec3Chain struct {
+	// hashes contains the sorted hashed owner names.
+	hashes []string
+
+	// types maps the hashed owner names to their types.
+	types map[string][]uint16
+
+	// zone is the signed zone.
+	zone *SignedZone
+}
+
+// Ensure that [*nsec3Chain] implements [denialChain].
+var _ denialChain = &nsec3Chain{}
+
+// newNSEC3Chain constructs a new [*nsec3Chain].
+func newNSEC3Chain(sz *SignedZone, names map[string][]uint16) *nsec3Chain {
+	chain := &nsec3Chain{types: map[string][]uint16{}, zone: sz}
+	for name, types := range names {
+		hash := chain.hash(name)
+		chain.hashes = append(chain.hashes, hash)
+		chain.types[hash] = types
+	}
+	slices.Sort(chain.hashes)
+	return chain
+}
+
+// hash returns the NSEC3 hash of the given name.
+func (nc *nsec3Chain) hash(name string) string {
+	return dns.HashName(name, dns.SHA1, nc.zone.nsec3.Iterations, nc.zone.nsec3.Salt)
+}
+
+// closestEncloser implements [denialChain].
+func (nc *nsec3Chain) closestEncloser(encloser, name, nextCloser string) []dns.RR {
+	return []dns.RR{nc.match(encloser), nc.cover(nextCloser)}
+}
+
+// cover implements [denialChain].
+func (nc *nsec3Chain) cover(name string) dns.RR {
+	idx, _ := slices.BinarySearch(nc.hashes, nc.hash(name))
+	return nc.record((idx - 1 + len(nc.hashes)) % len(nc.hashes))
+}
+
+// match implements [denialChain].
+func (nc *nsec3Chain) match(name string) dns.RR {
+	idx, found := slices.BinarySearch(nc.hashes, nc.hash(name))
+	if !found {
+		return nc.cover(name)
+	}
+	return nc.record(idx)
+}
+
+// nextCloser implements [denialChain].
+func (nc *nsec3Chain) nextCloser(name, nextCloser string) dns.RR {
+	return nc.cover(nextCloser)
+}
+
+// record returns the NSEC3 record at the given index.
+func (nc *nsec3Chain) record(idx int) dns.RR {
+	hash := nc.hashes[idx]
+	types := slices.Clone(nc.types[hash])
+	if len(types) > 0 {
+		types = append(types, dns.TypeRRSIG)
+		slices.Sort(types)
+	}
+	var flags uint8
+	if nc.zone.nsec3.OptOut {
+		flags = 1
+	}
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(hash) + "." + strings.TrimPrefix(nc.zone.name, "."),
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    signedZoneNegativeTTL,
+		},
+		Hash:       dns.SHA1,
+		Flags:      flags,
+		Iterations: nc.zone.nsec3.Iterations,
+		SaltLength: uint8(len(nc.zone.nsec3.Salt) / 2),
+		Salt:       strings.ToUpper(nc.zone.nsec3.Salt),
+		HashLength: 20,
+		NextDomain: nc.hashes[(idx+1)%len(nc.hashes)],
+		TypeBitMap: types,
+	}
+}
+
+// compareCanonicalNames compares two canonical names using the
+// canonical DNS name order (see RFC 4034 Sect. 6.1).
+func compareCanonicalNames(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for len(la) > 0 && len(lb) > 0 {
+		if rv := strings.Compare(la[len(la)-1], lb[len(lb)-1]); rv != 0 {
+			return rv
+		}
+		la, lb = la[:len(la)-1], lb[:len(lb)-1]
+	}
+	return len(la) - len(lb)
+}
@@ -0,0 +1,379 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newNSECTestConfig creates a config with the given signed zone containing
+// a regular name, a name only having records for a specific client subnet,
+// an empty non-terminal, and optionally a wildcard.
+func newNSECTestConfig(params *NSEC3Params, wildcard bool) (*HandlerConfig, *SignedZone) {
+	config := NewHandlerConfig()
+	var zone *SignedZone
+	switch params {
+	case nil:
+		zone = config.SignZone("example.com")
+	default:
+		zone = config.SignZoneWithNSEC3("example.com", params)
+	}
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	config.AddNetipAddr("www.ent.example.com", netip.MustParseAddr("172.66.144.113"))
+	config.AddSubnetNetipAddr("ecs.example.com", netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParseAddr("192.0.2.1"))
+	if wildcard {
+		config.AddNetipAddr("*.example.com", netip.MustParseAddr("8.8.8.8"))
+	}
+	return config, zone
+}
+
+// collectDenial returns the NSEC and NSEC3 records within the authority section.
+func collectDenial(resp *dns.Msg) (nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) {
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return
+}
+
+// nsecCovers returns whether the NSEC record covers the given name.
+func nsecCovers(rr *dns.NSEC, name string) bool {
+	name = dns.CanonicalName(name)
+	owner, next := rr.Hdr.Name, rr.NextDomain
+	if compareCanonicalNames(owner, next) < 0 {
+		return compareCanonicalNames(owner, name) < 0 && compareCanonicalNames(name, next) < 0
+	}
+	return compareCanonicalNames(owner, name) < 0 || compareCanonicalNames(name, next) < 0
+}
+
+// verifyDenialSignatures verifies the RRSIGs of the authority section using the zone signing key.
+func verifyDenialSignatures(t *testing.T, config *HandlerConfig, zone *SignedZone, resp *dns.Msg) {
+	zsk := NewHandler(config).PrepareResponse(newDNSSECTestQuery(zone.Name(), dns.TypeDNSKEY, true))
+	var key *dns.DNSKEY
+	for _, rr := range zsk.Answer {
+		if rr, ok := rr.(*dns.DNSKEY); ok && rr.Flags == dns.ZONE {
+			key = rr
+		}
+	}
+	sigs := collectRRSIGs(resp.Ns)
+	assert.NotEmpty(t, sigs)
+	for _, sig := range sigs {
+		verifyRRSIG(t, key, sig, resp.Ns)
+	}
+}
+
+func TestHandlerNSEC(t *testing.T) {
+	type testCase struct {
+		name        string
+		wildcard    bool
+		qname       string
+		qtype       uint16
+		expectRcode int
+		validate    func(t *testing.T, nsecs []*dns.NSEC)
+	}
+
+	testCases := []testCase{
+		{
+			name:        "NXDOMAIN proves the name and the wildcard do not exist",
+			qname:       "nonexistent.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeNameError,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.True(t, slices.ContainsFunc(nsecs, func(rr *dns.NSEC) bool {
+					return nsecCovers(rr, "nonexistent.example.com")
+				}))
+				assert.True(t, slices.ContainsFunc(nsecs, func(rr *dns.NSEC) bool {
+					return nsecCovers(rr, "*.example.com")
+				}))
+			},
+		},
+
+		{
+			name:        "NODATA proves the type does not exist",
+			qname:       "www.example.com",
+			qtype:       dns.TypeAAAA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.Len(t, nsecs, 1)
+				assert.Equal(t, "www.example.com.", nsecs[0].Hdr.Name)
+				assert.Equal(t, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}, nsecs[0].TypeBitMap)
+			},
+		},
+
+		{
+			name:        "NODATA for a subnet-only name matches the name",
+			qname:       "ecs.example.com",
+			qtype:       dns.TypeAAAA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.Len(t, nsecs, 1)
+				assert.Equal(t, "ecs.example.com.", nsecs[0].Hdr.Name)
+				assert.Equal(t, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}, nsecs[0].TypeBitMap)
+			},
+		},
+
+		{
+			name:        "NODATA at the apex excludes the DS",
+			qname:       "example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.Len(t, nsecs, 1)
+				assert.Equal(t, "example.com.", nsecs[0].Hdr.Name)
+				assert.Equal(t, []uint16{dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY},
+					nsecs[0].TypeBitMap)
+			},
+		},
+
+		{
+			name:        "NODATA for an empty non-terminal uses the covering NSEC",
+			qname:       "ent.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.Len(t, nsecs, 1)
+				assert.True(t, nsecCovers(nsecs[0], "ent.example.com"))
+			},
+		},
+
+		{
+			name:        "wildcard answer proves the name does not exist",
+			wildcard:    true,
+			qname:       "foo.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.Len(t, nsecs, 1)
+				assert.True(t, nsecCovers(nsecs[0], "foo.example.com"))
+			},
+		},
+
+		{
+			name:        "wildcard NODATA proves the name and the type do not exist",
+			wildcard:    true,
+			qname:       "foo.example.com",
+			qtype:       dns.TypeAAAA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsecs []*dns.NSEC) {
+				assert.True(t, slices.ContainsFunc(nsecs, func(rr *dns.NSEC) bool {
+					return nsecCovers(rr, "foo.example.com")
+				}))
+				assert.True(t, slices.ContainsFunc(nsecs, func(rr *dns.NSEC) bool {
+					return rr.Hdr.Name == "*.example.com." && !slices.Contains(rr.TypeBitMap, dns.TypeAAAA)
+				}))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, zone := newNSECTestConfig(nil, tc.wildcard)
+			resp := NewHandler(config).PrepareResponse(newDNSSECTestQuery(tc.qname, tc.qtype, true))
+			assert.Equal(t, tc.expectRcode, resp.Rcode)
+			nsecs, nsec3s := collectDenial(resp)
+			assert.Empty(t, nsec3s)
+			tc.validate(t, nsecs)
+			verifyDenialSignatures(t, config, zone, resp)
+		})
+	}
+}
+
+func TestHandlerNSEC3(t *testing.T) {
+	params := &NSEC3Params{Iterations: 5, OptOut: true, Salt: "aabbccdd"}
+
+	type testCase struct {
+		name        string
+		wildcard    bool
+		qname       string
+		qtype       uint16
+		expectRcode int
+		validate    func(t *testing.T, nsec3s []*dns.NSEC3)
+	}
+
+	// matches returns whether any record matches the given name.
+	matches := func(nsec3s []*dns.NSEC3, name string) bool {
+		return slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Match(name) })
+	}
+
+	// covers returns whether any record covers the given name.
+	covers := func(nsec3s []*dns.NSEC3, name string) bool {
+		return slices.ContainsFunc(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(name) })
+	}
+
+	testCases := []testCase{
+		{
+			name:        "NXDOMAIN includes the closest encloser proof",
+			qname:       "a.b.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeNameError,
+			validate: func(t *testing.T, nsec3s []*dns.NSEC3) {
+				assert.Len(t, nsec3s, 3)
+				assert.True(t, matches(nsec3s, "example.com."))
+				assert.True(t, covers(nsec3s, "b.example.com."))
+				assert.True(t, covers(nsec3s, "*.example.com."))
+			},
+		},
+
+		{
+			name:        "NODATA matches the name",
+			qname:       "www.example.com",
+			qtype:       dns.TypeAAAA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsec3s []*dns.NSEC3) {
+				assert.Len(t, nsec3s, 1)
+				assert.True(t, matches(nsec3s, "www.example.com."))
+				assert.Equal(t, []uint16{dns.TypeA, dns.TypeRRSIG}, nsec3s[0].TypeBitMap)
+			},
+		},
+
+		{
+			name:        "NODATA matches the subnet-only name",
+			qname:       "ecs.example.com",
+			qtype:       dns.TypeAAAA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsec3s []*dns.NSEC3) {
+				assert.Len(t, nsec3s, 1)
+				assert.True(t, matches(nsec3s, "ecs.example.com."))
+				assert.Equal(t, []uint16{dns.TypeA, dns.TypeRRSIG}, nsec3s[0].TypeBitMap)
+			},
+		},
+
+		{
+			name:        "NODATA matches the empty non-terminal",
+			qname:       "ent.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsec3s []*dns.NSEC3) {
+				assert.Len(t, nsec3s, 1)
+				assert.True(t, matches(nsec3s, "ent.example.com."))
+				assert.Empty(t, nsec3s[0].TypeBitMap)
+			},
+		},
+
+		{
+			name:        "wildcard answer covers the next closer",
+			wildcard:    true,
+			qname:       "a.b.example.com",
+			qtype:       dns.TypeA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsec3s []*dns.NSEC3) {
+				assert.Len(t, nsec3s, 1)
+				assert.True(t, covers(nsec3s, "b.example.com."))
+			},
+		},
+
+		{
+			name:        "wildcard NODATA matches the wildcard",
+			wildcard:    true,
+			qname:       "foo.example.com",
+			qtype:       dns.TypeAAAA,
+			expectRcode: dns.RcodeSuccess,
+			validate: func(t *testing.T, nsec3s []*dns.NSEC3) {
+				assert.True(t, matches(nsec3s, "example.com."))
+				assert.True(t, covers(nsec3s, "foo.example.com."))
+				assert.True(t, matches(nsec3s, "*.example.com."))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, zone := newNSECTestConfig(params, tc.wildcard)
+			resp := NewHandler(config).PrepareResponse(newDNSSECTestQuery(tc.qname, tc.qtype, true))
+			assert.Equal(t, tc.expectRcode, resp.Rcode)
+			nsecs, nsec3s := collectDenial(resp)
+			assert.Empty(t, nsecs)
+			for _, rr := range nsec3s {
+				assert.Equal(t, uint8(1), rr.Flags)
+				assert.Equal(t, uint16(5), rr.Iterations)
+				assert.Equal(t, "AABBCCDD", rr.Salt)
+			}
+			tc.validate(t, nsec3s)
+			verifyDenialSignatures(t, config, zone, resp)
+		})
+	}
+
+	t.Run("the apex contains the NSEC3PARAM", func(t *testing.T) {
+		config, _ := newNSECTestConfig(params, false)
+		rrs, found := config.Lookup("example.com", dns.TypeNSEC3PARAM)
+		assert.True(t, found)
+		assert.Len(t, rrs, 1)
+		assert.Equal(t, "AABBCCDD", rrs[0].(*dns.NSEC3PARAM).Salt)
+	})
+
+	t.Run("the invalid salt causes a panic", func(t *testing.T) {
+		assert.Panics(t, func() {
+			NewHandlerConfig().SignZoneWithNSEC3("example.com", &NSEC3Params{Salt: "xx"})
+		})
+	})
+}
+
+func TestHandlerWildcardAnswerSignature(t *testing.T) {
+	config, zone := newNSECTestConfig(nil, true)
+	resp := NewHandler(config).PrepareResponse(newDNSSECTestQuery("foo.example.com", dns.TypeA, true))
+	assert.Equal(t, []string{"8.8.8.8"}, collectAddrs(resp))
+
+	// the signature must cover the wildcard owner name
+	sigs := collectRRSIGs(resp.Answer)
+	assert.Len(t, sigs, 1)
+	assert.Equal(t, "foo.example.com.", sigs[0].Hdr.Name)
+	assert.Equal(t, uint8(2), sigs[0].Labels)
+	verifyDenialSignatures(t, config, zone, &dns.Msg{Ns: resp.Answer})
+}
+
+func TestHandlerNegativeAnswerSOA(t *testing.T) {
+	type testCase struct {
+		name      string
+		qname     string
+		do        bool
+		expectSOA bool
+	}
+
+	testCases := []testCase{
+		{"signed zone without DO", "nonexistent.example.com", false, true},
+		{"signed zone with DO", "nonexistent.example.com", true, true},
+		{"unsigned zone", "nonexistent.example.org", true, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, _ := newNSECTestConfig(nil, false)
+			resp := NewHandler(config).PrepareResponse(newDNSSECTestQuery(tc.qname, dns.TypeA, tc.do))
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			var soa *dns.SOA
+			for _, rr := range resp.Ns {
+				if rr, ok := rr.(*dns.SOA); ok {
+					soa = rr
+				}
+			}
+			assert.Equal(t, tc.expectSOA, soa != nil)
+			if soa != nil {
+				assert.Equal(t, uint32(signedZoneNegativeTTL), soa.Hdr.Ttl)
+			}
+			nsecs, _ := collectDenial(resp)
+			assert.Equal(t, tc.do && tc.expectSOA, len(nsecs) > 0)
+		})
+	}
+}
+
+func TestCompareCanonicalNames(t *testing.T) {
+	// see RFC 4034 Sect. 6.1
+	expect := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "z.a.example.",
+		"zabc.a.example.", "z.example.", "*.z.example.",
+	}
+	names := slices.Clone(expect)
+	slices.Reverse(names)
+	slices.SortFunc(names, compareCanonicalNames)
+	assert.Equal(t, expect, names)
+}
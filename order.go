@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// RecordOrder is a policy deciding the order of the records of a name
+// returned by the [*Handler] (see [*HandlerConfig.SetRecordOrder]).
+//
+// The policy receives a copy of an RRset (e.g., all the A records of the
+// name) in insertion order and returns the records to include into the
+// answer. The policy may be called concurrently.
+//
+// Construct using the RecordOrder* functions or write your own.
+type RecordOrder func(rrset []dns.RR) []dns.RR
+
+// RecordOrderFixed returns a [RecordOrder] that keeps the insertion order,
+// which is also the default when a name does not have a policy.
+func RecordOrderFixed() RecordOrder {
+	return func(rrset []dns.RR) []dns.RR {
+		return rrset
+	}
+}
+
+// RecordOrderRoundRobin returns a [RecordOrder] that rotates the records by
+// one position for each query, such that the first query returns the records
+// in insertion order, the second query starts from the second record, etc.
+func RecordOrderRoundRobin() RecordOrder {
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	return func(rrset []dns.RR) []dns.RR {
+		if len(rrset) <= 0 {
+			return rrset
+		}
+		mu.Lock()
+		offset := count % len(rrset)
+		count++
+		mu.Unlock()
+		return slices.Concat(rrset[offset:], rrset[:offset])
+	}
+}
+
+// RecordOrderShuffle returns a [RecordOrder] that randomly shuffles the records
+// using a pseudorandom generator initialized with the given seed, such that
+// the sequence of answers is reproducible across test runs.
+func RecordOrderShuffle(seed uint64) RecordOrder {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewPCG(seed, seed))
+	return func(rrset []dns.RR) []dns.RR {
+		mu.Lock()
+		rng.Shuffle(len(rrset), func(i, j int) {
+			rrset[i], rrset[j] = rrset[j], rrset[i]
+		})
+		mu.Unlock()
+		return rrset
+	}
+}
+
+// RecordOrderSubset returns a [RecordOrder] that applies the given policy,
+// or [RecordOrderFixed] if nil, and then only returns the first n records.
+//
+// This function PANICS if n is not positive.
+func RecordOrderSubset(n int, order RecordOrder) RecordOrder {
+	runtimex.Assert(n > 0)
+	if order == nil {
+		order = RecordOrderFixed()
+	}
+	return func(rrset []dns.RR) []dns.RR {
+		rrset = order(rrset)
+		return rrset[:min(n, len(rrset))]
+	}
+}
+
+// SetRecordOrder sets the [RecordOrder] for the given name. Use nil to
+// restore the default policy, which keeps the insertion order.
+//
+// This method is safe to call while the handler is running.
+func (c *HandlerConfig) SetRecordOrder(name string, order RecordOrder) {
+	name = dns.CanonicalName(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if order == nil {
+		delete(c.orders, name)
+		return
+	}
+	c.orders[name] = order
+}
+
+// applyRecordOrder applies the [RecordOrder] of the given name, if any, to the given RRset.
+func (c *HandlerConfig) applyRecordOrder(name string, rrset []dns.RR) []dns.RR {
+	c.mu.Lock()
+	order := c.orders[dns.CanonicalName(name)]
+	c.mu.Unlock()
+	if order == nil {
+		return rrset
+	}
+	return order(slices.Clone(rrset))
+}
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRecordOrderTestHandler creates a handler where www.example.com has four
+// A records and the given record order.
+func newRecordOrderTestHandler(order RecordOrder) *Handler {
+	config := NewHandlerConfig()
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		config.AddNetipAddr("www.example.com", netip.MustParseAddr(addr))
+	}
+	config.AddCNAME("alias.example.com", "www.example.com")
+	config.SetRecordOrder("www.example.com", order)
+	return NewHandler(config.Clone())
+}
+
+// queryRecordOrderTest queries the handler and returns the addresses in order.
+func queryRecordOrderTest(handler *Handler, name string) (output []string) {
+	query := &dns.Msg{}
+	query.SetQuestion(dns.CanonicalName(name), dns.TypeA)
+	for _, rr := range handler.PrepareResponse(query).Answer {
+		if rr, ok := rr.(*dns.A); ok {
+			output = append(output, rr.A.String())
+		}
+	}
+	return
+}
+
+func TestHandlerRecordOrder(t *testing.T) {
+	type testCase struct {
+		name   string
+		order  RecordOrder
+		qname  string
+		expect [][]string
+	}
+
+	testCases := []testCase{
+		{
+			name:  "default",
+			order: nil,
+			qname: "www.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+		},
+
+		{
+			name:  "fixed",
+			order: RecordOrderFixed(),
+			qname: "www.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+		},
+
+		{
+			name:  "round robin",
+			order: RecordOrderRoundRobin(),
+			qname: "www.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.1"},
+				{"10.0.0.3", "10.0.0.4", "10.0.0.1", "10.0.0.2"},
+				{"10.0.0.4", "10.0.0.1", "10.0.0.2", "10.0.0.3"},
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+		},
+
+		{
+			name:  "round robin through a CNAME",
+			order: RecordOrderRoundRobin(),
+			qname: "alias.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.1"},
+			},
+		},
+
+		{
+			name:  "subset",
+			order: RecordOrderSubset(2, nil),
+			qname: "www.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2"},
+				{"10.0.0.1", "10.0.0.2"},
+			},
+		},
+
+		{
+			name:  "subset with round robin",
+			order: RecordOrderSubset(2, RecordOrderRoundRobin()),
+			qname: "www.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2"},
+				{"10.0.0.2", "10.0.0.3"},
+			},
+		},
+
+		{
+			name:  "subset larger than the RRset",
+			order: RecordOrderSubset(10, nil),
+			qname: "www.example.com",
+			expect: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := newRecordOrderTestHandler(tc.order)
+			for _, expect := range tc.expect {
+				assert.Equal(t, expect, queryRecordOrderTest(handler, tc.qname))
+			}
+		})
+	}
+}
+
+func TestRecordOrderShuffle(t *testing.T) {
+	// collect returns the answers of the given number of queries using the given seed.
+	collect := func(seed uint64, count int) (output [][]string) {
+		handler := newRecordOrderTestHandler(RecordOrderShuffle(seed))
+		for range count {
+			output = append(output, queryRecordOrderTest(handler, "www.example.com"))
+		}
+		return
+	}
+
+	// the same seed yields the same sequence
+	first := collect(1, 16)
+	assert.Equal(t, first, collect(1, 16))
+
+	// the records are a permutation and the order changes
+	changed := false
+	for _, answer := range first {
+		assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, answer)
+		changed = changed || answer[0] != first[0][0]
+	}
+	assert.True(t, changed)
+}
+
+func TestHandlerConfigSetRecordOrderNil(t *testing.T) {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("10.0.0.1"))
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("10.0.0.2"))
+	config.SetRecordOrder("www.example.com", RecordOrderSubset(1, nil))
+	config.SetRecordOrder("www.example.com", nil)
+	assert.Len(t, queryRecordOrderTest(NewHandler(config), "www.example.com"), 2)
+}
+
+func TestRecordOrderSubsetInvalid(t *testing.T) {
+	assert.Panics(t, func() {
+		RecordOrderSubset(0, nil)
+	})
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"slices"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the block size that RFC 8467 recommends for responses.
+const paddingBlockSize = 468
+
+// paddingMaxLengths is the maximum number of query padding lengths we keep,
+// such that long-running servers do not use an unbounded amount of memory.
+const paddingMaxLengths = 1024
+
+// paddingHandler wraps a [dns.Handler] such that the responses to the
+// queries including the EDNS0 padding option (see RFC 7830) are padded
+// using the RFC 8467 block-length padding policy. We only pad responses
+// that include an OPT record and that the handler writes using WriteMsg.
+//
+// We also record the padding length used by each query.
+//
+// Construct using [newPaddingHandler].
+type paddingHandler struct {
+	// handler is the wrapped handler.
+	handler dns.Handler
+
+	// lengths contains the padding length of each padded query.
+	lengths []int
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// newPaddingHandler creates a new [*paddingHandler] wrapping the given handler.
+func newPaddingHandler(handler dns.Handler) *paddingHandler {
+	return &paddingHandler{
+		handler: handler,
+		lengths: []int{},
+		mu:      sync.Mutex{},
+	}
+}
+
+// Ensure that [*paddingHandler] implements [dns.Handler].
+var _ dns.Handler = &paddingHandler{}
+
+// ServeDNS implements [dns.Handler].
+func (ph *paddingHandler) ServeDNS(rw dns.ResponseWriter, query *dns.Msg) {
+	if length, found := queryPaddingLength(query); found {
+		ph.mu.Lock()
+		ph.lengths = append(ph.lengths, length)
+		if len(ph.lengths) > paddingMaxLengths {
+			ph.lengths = slices.Delete(ph.lengths, 0, len(ph.lengths)-paddingMaxLengths)
+		}
+		ph.mu.Unlock()
+		rw = &paddingResponseWriter{rw}
+	}
+	ph.handler.ServeDNS(rw, query)
+}
+
+// PaddingLengths returns a copy of the recorded query padding lengths.
+func (ph *paddingHandler) PaddingLengths() []int {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	return slices.Clone(ph.lengths)
+}
+
+// queryHasPadding returns whether the query includes the padding option.
+func queryHasPadding(query *dns.Msg) bool {
+	_, found := queryPaddingLength(query)
+	return found
+}
+
+// queryPaddingLength returns the length of the padding option of the
+// query and whether the query includes the padding option.
+func queryPaddingLength(query *dns.Msg) (int, bool) {
+	if opt := query.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if padding, ok := option.(*dns.EDNS0_PADDING); ok {
+				return len(padding.Padding), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// paddingResponseWriter is a [dns.ResponseWriter] padding the responses.
+type paddingResponseWriter struct {
+	dns.ResponseWriter
+}
+
+// Ensure that [*paddingResponseWriter] implements [dns.ConnectionStater].
+var _ dns.ConnectionStater = &paddingResponseWriter{}
+
+// ConnectionState implements [dns.ConnectionStater].
+func (w *paddingResponseWriter) ConnectionState() *tls.ConnectionState {
+	if stater, ok := w.ResponseWriter.(dns.ConnectionStater); ok {
+		return stater.ConnectionState()
+	}
+	return nil
+}
+
+// WriteMsg implements [dns.ResponseWriter].
+func (w *paddingResponseWriter) WriteMsg(resp *dns.Msg) error {
+	padResponse(resp)
+	return w.ResponseWriter.WriteMsg(resp)
+}
+
+// padResponse pads the response, when it contains an OPT record, such
+// that its wire length is a multiple of [paddingBlockSize].
+func padResponse(resp *dns.Msg) {
+	// 1. replace any existing padding with an empty padding option
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, option)
+		}
+	}
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(options, padding)
+
+	// 2. compute the padding length using the wire length
+	rawResp, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	padding.Padding = make([]byte, (paddingBlockSize-len(rawResp)%paddingBlockSize)%paddingBlockSize)
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPaddingTestQuery creates a query for www.example.com optionally including the padding option.
+func newPaddingTestQuery(padding bool) *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	query.SetEdns0(handlerEDNS0Size, false)
+	if padding {
+		opt := query.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+	}
+	return query
+}
+
+// validatePaddingTestResponse checks whether the raw response is padded.
+func validatePaddingTestResponse(t *testing.T, rawResp []byte, expectPadding bool) {
+	resp := &dns.Msg{}
+	assert.NoError(t, resp.Unpack(rawResp))
+	assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+	assert.Equal(t, expectPadding, queryHasPadding(resp))
+	if expectPadding {
+		assert.Equal(t, 0, len(rawResp)%paddingBlockSize)
+	}
+}
+
+// newPaddingTestEnv creates the handler, the certificate, and the PKI.
+func newPaddingTestEnv() (dns.Handler, tls.Certificate, *pkitest.PKI) {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+	return NewHandler(config), cert, pki
+}
+
+func TestTLSPadding(t *testing.T) {
+	handler, cert, pki := newPaddingTestEnv()
+	srv := MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, handler)
+	defer srv.Close()
+
+	for _, padding := range []bool{true, false} {
+		tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+		conn, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+		assert.NoError(t, err)
+		dconn := &dns.Conn{Conn: conn}
+		assert.NoError(t, dconn.WriteMsg(newPaddingTestQuery(padding)))
+		rawResp, err := dconn.ReadMsgHeader(nil)
+		assert.NoError(t, err)
+		validatePaddingTestResponse(t, rawResp, padding)
+		conn.Close()
+	}
+	assert.Equal(t, []int{100}, srv.PaddingLengths())
+}
+
+func TestHTTPSPadding(t *testing.T) {
+	handler, cert, pki := newPaddingTestEnv()
+	srv := MustNewHTTPSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, handler)
+	defer srv.Close()
+
+	tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg, ForceAttemptHTTP2: true}}
+	defer client.CloseIdleConnections()
+
+	for _, padding := range []bool{true, false} {
+		rawQuery := runtimex.PanicOnError1(newPaddingTestQuery(padding).Pack())
+		httpReq := runtimex.PanicOnError1(http.NewRequest("POST", srv.URL(), bytes.NewReader(rawQuery)))
+		httpReq.Header.Set("content-type", "application/dns-message")
+		httpResp, err := client.Do(httpReq)
+		assert.NoError(t, err)
+		rawResp, err := io.ReadAll(httpResp.Body)
+		assert.NoError(t, err)
+		httpResp.Body.Close()
+		validatePaddingTestResponse(t, rawResp, padding)
+	}
+	assert.Equal(t, []int{100}, srv.PaddingLengths())
+}
+
+func TestUDPDoesNotPad(t *testing.T) {
+	handler, _, _ := newPaddingTestEnv()
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	defer srv.Close()
+
+	resp, err := dns.Exchange(newPaddingTestQuery(true), srv.Address())
+	assert.NoError(t, err)
+	assert.False(t, queryHasPadding(resp))
+}
+
+func TestPadResponse(t *testing.T) {
+	t.Run("without OPT we do not pad", func(t *testing.T) {
+		resp := &dns.Msg{}
+		resp.SetQuestion("www.example.com.", dns.TypeA)
+		padResponse(resp)
+		assert.Nil(t, resp.IsEdns0())
+	})
+
+	t.Run("we replace the existing padding", func(t *testing.T) {
+		resp := newPaddingTestQuery(true)
+		padResponse(resp)
+		rawResp := runtimex.PanicOnError1(resp.Pack())
+		assert.Equal(t, paddingBlockSize, len(rawResp))
+		assert.Len(t, resp.IsEdns0().Option, 1)
+	})
+}
+
+func TestPaddingHandlerKeepsRecentLengths(t *testing.T) {
+	ph := newPaddingHandler(dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {}))
+	for idx := range paddingMaxLengths + 10 {
+		query := newPaddingTestQuery(false)
+		opt := query.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, idx)})
+		ph.ServeDNS(nil, query)
+	}
+	lengths := ph.PaddingLengths()
+	assert.Len(t, lengths, paddingMaxLengths)
+	assert.Equal(t, 10, lengths[0])
+	assert.Equal(t, paddingMaxLengths+9, lengths[len(lengths)-1])
+}
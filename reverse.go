@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+)
+
+// AddPTR adds a PTR record mapping the given [netip.Addr] to the given name
+// inside the in-addr.arpa or ip6.arpa tree (see RFC 1035 and RFC 3596).
+//
+// Adding the same mapping more than once has no effect.
+//
+// This method PANICS if the address is invalid.
+func (c *HandlerConfig) AddPTR(addr netip.Addr, name string) {
+	c.mu.Lock()
+	c.addPTRLocked(addr, dns.CanonicalName(name))
+	c.mu.Unlock()
+}
+
+// SetAutoPTR controls whether [*HandlerConfig.AddNetipAddr] and
+// [*HandlerConfig.AddSubnetNetipAddr] also invoke [*HandlerConfig.AddPTR]
+// for each address, which is disabled by default. Enabling this option does
+// not affect the addresses previously added. Likewise, [*HandlerConfig.Remove]
+// does not remove the PTR records added automatically.
+//
+// This method is safe to call while the handler is running.
+func (c *HandlerConfig) SetAutoPTR(enabled bool) {
+	c.mu.Lock()
+	c.autoPTR = enabled
+	c.mu.Unlock()
+}
+
+// LookupAddr returns the canonical names the given [netip.Addr] maps to
+// according to the PTR records, which is what [*net.Resolver.LookupAddr]
+// would return when using the [*Handler].
+//
+// This method PANICS if the address is invalid.
+func (c *HandlerConfig) LookupAddr(addr netip.Addr) []string {
+	records, _ := c.Lookup(reverseAddrName(addr), dns.TypePTR)
+	var names []string
+	for _, rr := range records {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return names
+}
+
+// reverseAddrName returns the in-addr.arpa or ip6.arpa name of the [netip.Addr].
+//
+// This function PANICS if the address is invalid.
+func reverseAddrName(addr netip.Addr) string {
+	return runtimex.PanicOnError1(dns.ReverseAddr(addr.Unmap().WithZone("").String()))
+}
+
+// maybeAddPTRLocked adds the PTR record when [*HandlerConfig.SetAutoPTR] is enabled.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) maybeAddPTRLocked(addr netip.Addr, name string) {
+	if c.autoPTR {
+		c.addPTRLocked(addr, name)
+	}
+}
+
+// addPTRLocked adds the PTR record unless it already exists.
+//
+// This method MUST be called while holding the mutex.
+func (c *HandlerConfig) addPTRLocked(addr netip.Addr, name string) {
+	reverse := reverseAddrName(addr)
+	for _, rr := range c.rrs[reverse] {
+		if ptr, ok := rr.(*dns.PTR); ok && ptr.Ptr == name {
+			return
+		}
+	}
+	c.addRRsLocked(reverse, &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   reverse,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    handlerDefaultTTL,
+		},
+		Ptr: name,
+	})
+}
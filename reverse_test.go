@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerConfigLookupAddr(t *testing.T) {
+	type testCase struct {
+		name      string
+		configure func(config *HandlerConfig)
+		addr      string
+		expect    []string
+	}
+
+	testCases := []testCase{
+		{
+			name: "disabled by default",
+			configure: func(config *HandlerConfig) {
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("192.0.2.1"))
+			},
+			addr:   "192.0.2.1",
+			expect: nil,
+		},
+
+		{
+			name: "automatic IPv4",
+			configure: func(config *HandlerConfig) {
+				config.SetAutoPTR(true)
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("192.0.2.1"))
+			},
+			addr:   "192.0.2.1",
+			expect: []string{"www.example.com."},
+		},
+
+		{
+			name: "automatic IPv6",
+			configure: func(config *HandlerConfig) {
+				config.SetAutoPTR(true)
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("2001:db8::1"))
+			},
+			addr:   "2001:db8::1",
+			expect: []string{"www.example.com."},
+		},
+
+		{
+			name: "automatic with subnets",
+			configure: func(config *HandlerConfig) {
+				config.SetAutoPTR(true)
+				config.AddSubnetNetipAddr("www.example.com",
+					netip.MustParsePrefix("198.51.100.0/24"), netip.MustParseAddr("192.0.2.1"))
+			},
+			addr:   "192.0.2.1",
+			expect: []string{"www.example.com."},
+		},
+
+		{
+			name: "automatic without duplicates",
+			configure: func(config *HandlerConfig) {
+				config.SetAutoPTR(true)
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("192.0.2.1"))
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("192.0.2.1"))
+				config.AddNetipAddr("example.com", netip.MustParseAddr("192.0.2.1"))
+			},
+			addr:   "192.0.2.1",
+			expect: []string{"www.example.com.", "example.com."},
+		},
+
+		{
+			name: "explicit",
+			configure: func(config *HandlerConfig) {
+				config.AddPTR(netip.MustParseAddr("::ffff:192.0.2.1"), "www.example.com")
+			},
+			addr:   "192.0.2.1",
+			expect: []string{"www.example.com."},
+		},
+
+		{
+			name:      "nonexistent",
+			configure: func(config *HandlerConfig) {},
+			addr:      "192.0.2.1",
+			expect:    nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewHandlerConfig()
+			tc.configure(config)
+			assert.Equal(t, tc.expect, config.Clone().LookupAddr(netip.MustParseAddr(tc.addr)))
+		})
+	}
+}
+
+func TestHandlerPTRWithNetResolver(t *testing.T) {
+	// create config
+	config := NewHandlerConfig()
+	config.SetAutoPTR(true)
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("192.0.2.1"))
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("2001:db8::1"))
+
+	// create server
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config))
+	defer srv.Close()
+
+	// create a resolver using the server
+	reso := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", srv.Address())
+		},
+	}
+
+	// make sure reverse lookups work for both families
+	for _, addr := range []string{"192.0.2.1", "2001:db8::1"} {
+		names, err := reso.LookupAddr(context.Background(), addr)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com."}, names)
+	}
+
+	// make sure the raw response contains the PTR record
+	query := &dns.Msg{}
+	query.SetQuestion("1.2.0.192.in-addr.arpa.", dns.TypePTR)
+	resp, err := dns.Exchange(query, srv.Address())
+	assert.NoError(t, err)
+	assert.Len(t, resp.Answer, 1)
+}
+
+func TestHandlerConfigAddPTRInvalid(t *testing.T) {
+	assert.Panics(t, func() {
+		NewHandlerConfig().AddPTR(netip.Addr{}, "www.example.com")
+	})
+}
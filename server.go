@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import "github.com/miekg/dns"
+
+// startDNSServer runs the given [*dns.Server] in the background and closes
+// done when it stops serving. We wait for the server to be started before
+// returning, since calling Shutdown on a server that has not started yet
+// fails, which would cause Close to panic.
+func startDNSServer(srv *dns.Server, done chan struct{}) {
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() {
+		close(started)
+	}
+	go func() {
+		srv.ActivateAndServe()
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-done:
+	}
+}
@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+)
+
+func TestServersCloseImmediately(t *testing.T) {
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+	handler := NewHandler(NewHandlerConfig())
+
+	// closing right after creating must not panic
+	for range 100 {
+		MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", handler).Close()
+		MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", handler).Close()
+		MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, handler).Close()
+	}
+}
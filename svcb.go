@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// SVCBParams contains the service parameters (see RFC 9460) used
+// by [*HandlerConfig.AddSVCB] and [*HandlerConfig.AddHTTPS].
+//
+// All fields are OPTIONAL and we omit the zero-valued ones.
+type SVCBParams struct {
+	// ALPN contains the alpn parameter (e.g., "h2", "dot").
+	ALPN []string
+
+	// DoHPath contains the dohpath parameter (see RFC 9461), which
+	// is a URI template such as "/dns-query{?dns}".
+	DoHPath string
+
+	// ECH contains the ech parameter (e.g., [ECHConfig] ConfigList).
+	ECH []byte
+
+	// IPv4Hint contains the ipv4hint parameter.
+	IPv4Hint []netip.Addr
+
+	// IPv6Hint contains the ipv6hint parameter.
+	IPv6Hint []netip.Addr
+
+	// Port contains the port parameter.
+	Port uint16
+}
+
+// svcbKeyValues converts the [*SVCBParams] to [dns.SVCBKeyValue] sorted by key.
+func (p *SVCBParams) svcbKeyValues() (output []dns.SVCBKeyValue) {
+	if p == nil {
+		return nil
+	}
+	if len(p.ALPN) > 0 {
+		output = append(output, &dns.SVCBAlpn{Alpn: append([]string{}, p.ALPN...)})
+	}
+	if p.Port != 0 {
+		output = append(output, &dns.SVCBPort{Port: p.Port})
+	}
+	if len(p.IPv4Hint) > 0 {
+		hint := &dns.SVCBIPv4Hint{}
+		for _, addr := range p.IPv4Hint {
+			hint.Hint = append(hint.Hint, addr.AsSlice())
+		}
+		output = append(output, hint)
+	}
+	if len(p.ECH) > 0 {
+		output = append(output, &dns.SVCBECHConfig{ECH: append([]byte{}, p.ECH...)})
+	}
+	if len(p.IPv6Hint) > 0 {
+		hint := &dns.SVCBIPv6Hint{}
+		for _, addr := range p.IPv6Hint {
+			hint.Hint = append(hint.Hint, addr.AsSlice())
+		}
+		output = append(output, hint)
+	}
+	if p.DoHPath != "" {
+		output = append(output, &dns.SVCBDoHPath{Template: p.DoHPath})
+	}
+	return
+}
+
+// newSVCB creates a new [dns.SVCB] with the given type, which
+// should be either [dns.TypeSVCB] or [dns.TypeHTTPS].
+func newSVCB(rrtype uint16, name string, priority uint16, target string, params *SVCBParams) dns.SVCB {
+	return dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: rrtype,
+			Class:  dns.ClassINET,
+			Ttl:    handlerDefaultTTL,
+		},
+		Priority: priority,
+		Target:   dns.CanonicalName(target),
+		Value:    params.svcbKeyValues(),
+	}
+}
+
+// AddSVCB adds an SVCB record for the given name.
+//
+// A zero priority means AliasMode, where params should be nil, while a
+// nonzero priority means ServiceMode. A "." target means that the target
+// is the owner name (ServiceMode) or that the service is not available
+// (AliasMode). The params may be nil.
+func (c *HandlerConfig) AddSVCB(name string, priority uint16, target string, params *SVCBParams) {
+	name = dns.CanonicalName(name)
+	record := newSVCB(dns.TypeSVCB, name, priority, target, params)
+
+	c.mu.Lock()
+	c.addRRsLocked(name, &record)
+	c.mu.Unlock()
+}
+
+// AddHTTPS adds an HTTPS record for the given name.
+//
+// The arguments have the same semantics as in [*HandlerConfig.AddSVCB].
+func (c *HandlerConfig) AddHTTPS(name string, priority uint16, target string, params *SVCBParams) {
+	name = dns.CanonicalName(name)
+	record := &dns.HTTPS{SVCB: newSVCB(dns.TypeHTTPS, name, priority, target, params)}
+
+	c.mu.Lock()
+	c.addRRsLocked(name, record)
+	c.mu.Unlock()
+}
+
+// AddECHConfigList adds an HTTPS record for the given name, in ServiceMode
+// and using the name itself as the target, carrying the given ECHConfigList
+// (e.g., [ECHConfig] ConfigList) as the ech parameter.
+func (c *HandlerConfig) AddECHConfigList(name string, configList []byte) {
+	c.AddHTTPS(name, 1, ".", &SVCBParams{ECH: configList})
+}
+
+// svcbAdditionals returns the A and AAAA records of the targets of the SVCB and
+// HTTPS records in answer, to include in the additional section (see RFC 9460).
+func (h *Handler) svcbAdditionals(answer []dns.RR) (output []dns.RR) {
+	seen := map[string]bool{}
+	for _, rr := range answer {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			continue
+		}
+
+		// figure out the target name taking into account "."
+		target := svcb.Target
+		if target == "." {
+			if svcb.Priority == 0 {
+				continue // AliasMode: the service is not available
+			}
+			target = svcb.Hdr.Name
+		}
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			records, _ := h.cfg.Lookup(target, qtype)
+			output = append(output, records...)
+		}
+	}
+	return
+}
@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// collectExtraAddrs is like collectAddrs but for the additional section.
+func collectExtraAddrs(resp *dns.Msg) []string {
+	return collectAddrs(&dns.Msg{Answer: resp.Extra})
+}
+
+func TestHandlerSVCB(t *testing.T) {
+	type testCase struct {
+		name           string
+		getConfig      func() *HandlerConfig
+		qname          string
+		qtype          uint16
+		validateAnswer func(t *testing.T, resp *dns.Msg)
+	}
+
+	testCases := []testCase{
+		{
+			name: "HTTPS ServiceMode with all the params",
+			getConfig: func() *HandlerConfig {
+				config := NewHandlerConfig()
+				config.AddHTTPS("www.example.com", 1, "svc.example.com", &SVCBParams{
+					ALPN:     []string{"h2", "h3"},
+					ECH:      []byte{0x00, 0x01, 0x02},
+					IPv4Hint: []netip.Addr{netip.MustParseAddr("104.20.34.220")},
+					IPv6Hint: []netip.Addr{netip.MustParseAddr("2606:4700::6812:1a78")},
+					Port:     8443,
+				})
+				config.AddNetipAddr("svc.example.com", netip.MustParseAddr("104.20.34.220"))
+				config.AddNetipAddr("svc.example.com", netip.MustParseAddr("2606:4700::6812:1a78"))
+				return config
+			},
+			qname: "www.example.com",
+			qtype: dns.TypeHTTPS,
+			validateAnswer: func(t *testing.T, resp *dns.Msg) {
+				assert.Len(t, resp.Answer, 1)
+				https := resp.Answer[0].(*dns.HTTPS)
+				assert.Equal(t, uint16(1), https.Priority)
+				assert.Equal(t, "svc.example.com.", https.Target)
+				expect := `1 svc.example.com. alpn="h2,h3" port="8443" ipv4hint="104.20.34.220" ` +
+					`ech="AAEC" ipv6hint="2606:4700::6812:1a78"`
+				assert.Equal(t, expect, https.SVCB.String()[len(https.Hdr.String()):])
+				assert.Equal(t, []string{"104.20.34.220", "2606:4700::6812:1a78"}, collectExtraAddrs(resp))
+			},
+		},
+
+		{
+			name: "HTTPS ServiceMode with the owner as the target",
+			getConfig: func() *HandlerConfig {
+				config := NewHandlerConfig()
+				config.AddHTTPS("www.example.com", 1, ".", &SVCBParams{ALPN: []string{"h2"}})
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+				return config
+			},
+			qname: "www.example.com",
+			qtype: dns.TypeHTTPS,
+			validateAnswer: func(t *testing.T, resp *dns.Msg) {
+				assert.Len(t, resp.Answer, 1)
+				assert.Equal(t, []string{"104.20.34.220"}, collectExtraAddrs(resp))
+			},
+		},
+
+		{
+			name: "HTTPS AliasMode",
+			getConfig: func() *HandlerConfig {
+				config := NewHandlerConfig()
+				config.AddHTTPS("example.com", 0, "cdn.example.net", nil)
+				config.AddNetipAddr("cdn.example.net", netip.MustParseAddr("172.66.144.113"))
+				return config
+			},
+			qname: "example.com",
+			qtype: dns.TypeHTTPS,
+			validateAnswer: func(t *testing.T, resp *dns.Msg) {
+				assert.Len(t, resp.Answer, 1)
+				https := resp.Answer[0].(*dns.HTTPS)
+				assert.Equal(t, uint16(0), https.Priority)
+				assert.Empty(t, https.Value)
+				assert.Equal(t, []string{"172.66.144.113"}, collectExtraAddrs(resp))
+			},
+		},
+
+		{
+			name: "HTTPS AliasMode with the service not available",
+			getConfig: func() *HandlerConfig {
+				config := NewHandlerConfig()
+				config.AddHTTPS("example.com", 0, ".", nil)
+				config.AddNetipAddr("example.com", netip.MustParseAddr("172.66.144.113"))
+				return config
+			},
+			qname: "example.com",
+			qtype: dns.TypeHTTPS,
+			validateAnswer: func(t *testing.T, resp *dns.Msg) {
+				assert.Len(t, resp.Answer, 1)
+				assert.Empty(t, resp.Extra)
+			},
+		},
+
+		{
+			name: "SVCB with multiple records sharing the target",
+			getConfig: func() *HandlerConfig {
+				config := NewHandlerConfig()
+				config.AddSVCB("_dns.example.com", 1, "dns.example.com", &SVCBParams{ALPN: []string{"dot"}})
+				config.AddSVCB("_dns.example.com", 2, "dns.example.com", &SVCBParams{ALPN: []string{"h2"}})
+				config.AddNetipAddr("dns.example.com", netip.MustParseAddr("127.0.0.1"))
+				return config
+			},
+			qname: "_dns.example.com",
+			qtype: dns.TypeSVCB,
+			validateAnswer: func(t *testing.T, resp *dns.Msg) {
+				assert.Len(t, resp.Answer, 2)
+				assert.Equal(t, []string{"127.0.0.1"}, collectExtraAddrs(resp))
+			},
+		},
+
+		{
+			name: "A query does not include additionals",
+			getConfig: func() *HandlerConfig {
+				config := NewHandlerConfig()
+				config.AddHTTPS("www.example.com", 1, ".", nil)
+				config.AddNetipAddr("www.example.com", netip.MustParseAddr("104.20.34.220"))
+				return config
+			},
+			qname: "www.example.com",
+			qtype: dns.TypeA,
+			validateAnswer: func(t *testing.T, resp *dns.Msg) {
+				assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(resp))
+				assert.Empty(t, resp.Extra)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// create server
+			srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(tc.getConfig()))
+			defer srv.Close()
+
+			// create query
+			query := &dns.Msg{}
+			query.Question = append(query.Question, dns.Question{
+				Name:   dns.CanonicalName(tc.qname),
+				Qtype:  tc.qtype,
+				Qclass: dns.ClassINET,
+			})
+
+			// exchange
+			resp, err := dns.Exchange(query, srv.Address())
+			assert.NoError(t, err)
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			tc.validateAnswer(t, resp)
+		})
+	}
+}
@@ -31,10 +31,7 @@ func MustNewTCPServer(lc TCPListenConfig, address string, handler dns.Handler) *
 			Handler:  handler,
 		},
 	}
-	go func() {
-		srv.srv.ActivateAndServe() // in background
-		close(srv.done)
-	}()
+	startDNSServer(srv.srv, srv.done)
 	return srv
 }
 
@@ -5,6 +5,7 @@ package dnstest
 import (
 	"context"
 	"crypto/tls"
+	"io"
 	"net"
 
 	"github.com/bassosimone/runtimex"
@@ -21,26 +22,47 @@ var _ TLSListenConfig = &net.ListenConfig{}
 
 // MustNewTLSServer returns a new [*TLSServer] ready to use.
 //
+// When the query includes the EDNS0 padding option, the server pads the
+// response written by the handler to a multiple of 468 bytes (see RFC 8467).
+// Use PaddingLengths to inspect the padding length used by the queries.
+//
 // This method PANICS on failure.
 func MustNewTLSServer(lc TLSListenConfig, address string, cert tls.Certificate, handler dns.Handler) *TLSServer {
-	listener := runtimex.PanicOnError1(lc.Listen(context.Background(), "tcp", address))
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
-	tlsListener := tls.NewListener(listener, config)
+	return MustNewTLSServerWithConfig(lc, address, config, handler)
+}
+
+// MustNewTLSServerWithConfig is like [MustNewTLSServer] but uses the given
+// [*tls.Config], which allows to control, e.g., the TLS versions, the cipher
+// suites, the ALPN protocols (e.g., "dot"), and session tickets.
+//
+// The config MUST contain at least a certificate (or a GetCertificate
+// callback). We clone the config, so the caller may reuse it. The config
+// KeyLogWriter, if set, is the initial [*TLSServer.SetKeyLogWriter] value.
+//
+// This method PANICS on failure.
+func MustNewTLSServerWithConfig(
+	lc TLSListenConfig, address string, config *tls.Config, handler dns.Handler) *TLSServer {
+	listener := newTLSFaultListener(runtimex.PanicOnError1(lc.Listen(context.Background(), "tcp", address)))
+	config = config.Clone()
+	inspector := newTLSInspector(config)
+	tlsListener := inspector.Listener(tls.NewListener(listener, config))
+	padding := newPaddingHandler(handler)
 	srv := &TLSServer{
-		address: listener.Addr().String(),
-		done:    make(chan struct{}),
+		address:   listener.Addr().String(),
+		done:      make(chan struct{}),
+		inspector: inspector,
+		listener:  listener,
+		padding:   padding,
 		srv: &dns.Server{
 			Listener:  tlsListener,
-			Handler:   handler,
+			Handler:   padding,
 			TLSConfig: config,
 		},
 	}
-	go func() {
-		srv.srv.ActivateAndServe() // in background
-		close(srv.done)
-	}()
+	startDNSServer(srv.srv, srv.done)
 	return srv
 }
 
@@ -52,6 +74,15 @@ type TLSServer struct {
 	// done is closed when done.
 	done chan struct{}
 
+	// inspector writes the key log and records the TLS state.
+	inspector *tlsInspector
+
+	// listener is the listener injecting handshake faults.
+	listener *tlsFaultListener
+
+	// padding pads the responses and records the query padding.
+	padding *paddingHandler
+
 	// srv is the server.
 	srv *dns.Server
 }
@@ -66,3 +97,37 @@ func (srv *TLSServer) Close() {
 	runtimex.PanicOnError0(srv.srv.Shutdown())
 	<-srv.done
 }
+
+// SetHandshakeFault sets the [TLSHandshakeFault] to inject for new connections.
+//
+// This method is safe to call while the server is running.
+func (srv *TLSServer) SetHandshakeFault(fault TLSHandshakeFault) {
+	srv.listener.SetFault(fault)
+}
+
+// SetKeyLogWriter sets the [io.Writer] where to write the TLS key log using
+// the NSS key log format, which allows to decrypt the traffic using, e.g.,
+// Wireshark. Use nil to stop writing the key log.
+//
+// This method is safe to call while the server is running.
+func (srv *TLSServer) SetKeyLogWriter(w io.Writer) {
+	srv.inspector.SetKeyLogWriter(w)
+}
+
+// ConnectionStates returns the [tls.ConnectionState] of each connection, in
+// the order in which the handshakes completed, which allows to inspect the
+// negotiated version, cipher suite, ALPN, resumption, and SNI.
+//
+// We only record the connections whose handshake completed successfully,
+// which excludes, e.g., the ones rejected by the client, and we only keep
+// the 1024 most recent states.
+func (srv *TLSServer) ConnectionStates() []tls.ConnectionState {
+	return srv.inspector.ConnectionStates()
+}
+
+// PaddingLengths returns the length of the EDNS0 padding option (see RFC 7830)
+// of each query including such an option, in the order in which we received
+// the queries. We only keep the 1024 most recent lengths.
+func (srv *TLSServer) PaddingLengths() []int {
+	return srv.padding.PaddingLengths()
+}
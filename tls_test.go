@@ -59,3 +59,84 @@ func TestTLSWorks(t *testing.T) {
 	expect := []string{"2606:4700::6812:1a78", "2606:4700::6812:1b78"}
 	assert.Equal(t, expect, addrs)
 }
+
+func TestTLSWithConfig(t *testing.T) {
+	// create config
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("2606:4700::6812:1a78"))
+
+	// create handler
+	handler := NewHandler(config)
+
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create a TLS 1.2-only server enforcing the "dot" ALPN
+	srv := MustNewTLSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"dot"},
+	}, handler)
+	defer srv.Close()
+
+	t.Run("with a compatible client", func(t *testing.T) {
+		// dial
+		tlsCfg := &tls.Config{
+			NextProtos: []string{"dot"},
+			RootCAs:    pki.CertPool(),
+			ServerName: "dns.example.com",
+		}
+		conn, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		// check the negotiated parameters
+		state := conn.ConnectionState()
+		assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+		assert.Equal(t, "dot", state.NegotiatedProtocol)
+
+		// exchange
+		query := &dns.Msg{}
+		query.Question = append(query.Question, dns.Question{
+			Name:   dns.CanonicalName("www.example.com"),
+			Qtype:  dns.TypeAAAA,
+			Qclass: dns.ClassINET,
+		})
+		dconn := &dns.Conn{Conn: conn}
+		err = dconn.WriteMsg(query)
+		assert.NoError(t, err)
+		resp, err := dconn.ReadMsg()
+		assert.NoError(t, err)
+
+		// get results
+		addrs := collectAddrs(resp)
+		expect := []string{"2606:4700::6812:1a78"}
+		assert.Equal(t, expect, addrs)
+	})
+
+	t.Run("with a TLS 1.3-only client", func(t *testing.T) {
+		tlsCfg := &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			NextProtos: []string{"dot"},
+			RootCAs:    pki.CertPool(),
+			ServerName: "dns.example.com",
+		}
+		_, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("with a client using the wrong ALPN", func(t *testing.T) {
+		tlsCfg := &tls.Config{
+			NextProtos: []string{"h2"},
+			RootCAs:    pki.CertPool(),
+			ServerName: "dns.example.com",
+		}
+		_, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+		assert.Error(t, err)
+	})
+}
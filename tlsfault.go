@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/bassosimone/runtimex"
+)
+
+// TLSCertFault is a certificate fault for [MustNewFaultyCert].
+type TLSCertFault int
+
+const (
+	// TLSCertFaultExpired generates an expired certificate that is
+	// otherwise valid for the configured names and trusted.
+	TLSCertFaultExpired = TLSCertFault(iota + 1)
+
+	// TLSCertFaultWrongSAN generates a trusted certificate that
+	// is only valid for the wrong-san.invalid name.
+	TLSCertFaultWrongSAN
+
+	// TLSCertFaultUntrusted generates a certificate that is valid
+	// for the configured names but is not trusted.
+	TLSCertFaultUntrusted
+)
+
+// tlsCertFaultWrongSAN is the name used by [TLSCertFaultWrongSAN].
+const tlsCertFaultWrongSAN = "wrong-san.invalid"
+
+// MustNewFaultyCert returns a [tls.Certificate] affected by the given fault
+// for use with [MustNewTLSServer] or [MustNewHTTPSServer].
+//
+// Trusted certificates are added to the pki CertPool, so clients using
+// such a pool fail because of the fault and not for other reasons.
+//
+// This function PANICS on failure.
+func MustNewFaultyCert(
+	pki *pkitest.PKI, fault TLSCertFault, config *pkitest.SelfSignedCertConfig) tls.Certificate {
+	switch fault {
+	case TLSCertFaultExpired:
+		// Note: we bypass the pki cache because it regenerates
+		// certificates that are expired or about to expire.
+		expired := *config
+		expired.ExpireAfter = time.Nanosecond
+		cert := mustNewSelfSignedTLSCert(&expired)
+		pki.CertPool().AddCert(cert.Leaf)
+		return cert
+
+	case TLSCertFaultWrongSAN:
+		return pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+			CommonName:   tlsCertFaultWrongSAN,
+			DNSNames:     []string{tlsCertFaultWrongSAN},
+			Organization: config.Organization,
+		})
+
+	case TLSCertFaultUntrusted:
+		return mustNewSelfSignedTLSCert(config)
+
+	default:
+		panic("dnstest: unknown TLSCertFault")
+	}
+}
+
+// mustNewSelfSignedTLSCert returns a self-signed [tls.Certificate] that is not trusted.
+func mustNewSelfSignedTLSCert(config *pkitest.SelfSignedCertConfig) tls.Certificate {
+	cert := pkitest.MustNewSelfSignedCert(config)
+	return runtimex.PanicOnError1(tls.X509KeyPair(cert.CertPEM, cert.KeyPEM))
+}
+
+// TLSHandshakeFault is a TLS handshake fault injected by [*TLSServer]
+// and [*HTTPSServer] after receiving the ClientHello.
+type TLSHandshakeFault int
+
+const (
+	// TLSHandshakeFaultNone disables handshake faults.
+	TLSHandshakeFaultNone = TLSHandshakeFault(iota)
+
+	// TLSHandshakeFaultStall reads the ClientHello and then does not
+	// send anything until the client or the server close the connection.
+	TLSHandshakeFaultStall
+
+	// TLSHandshakeFaultAlert reads the ClientHello and then sends a fatal
+	// handshake_failure alert and closes the connection.
+	TLSHandshakeFaultAlert
+
+	// TLSHandshakeFaultReset reads the ClientHello and then closes
+	// the connection, sending a TCP RST segment to the client.
+	TLSHandshakeFaultReset
+)
+
+// tlsAlertHandshakeFailure is a TLS record containing a fatal handshake_failure alert.
+var tlsAlertHandshakeFailure = []byte{
+	0x15,       // content type: alert
+	0x03, 0x03, // legacy record version: TLS 1.2
+	0x00, 0x02, // length
+	0x02, // level: fatal
+	0x28, // description: handshake_failure
+}
+
+// tlsFaultListener is a [net.Listener] injecting [TLSHandshakeFault].
+type tlsFaultListener struct {
+	// closed indicates that the listener has been closed.
+	closed bool
+
+	// conns contains the connections serving a fault.
+	conns map[net.Conn]struct{}
+
+	// fault is the fault to inject.
+	fault TLSHandshakeFault
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// net.Listener is the underlying listener.
+	net.Listener
+}
+
+// newTLSFaultListener creates a new [*tlsFaultListener].
+func newTLSFaultListener(listener net.Listener) *tlsFaultListener {
+	return &tlsFaultListener{
+		closed:   false,
+		conns:    map[net.Conn]struct{}{},
+		fault:    TLSHandshakeFaultNone,
+		mu:       sync.Mutex{},
+		Listener: listener,
+	}
+}
+
+// SetFault sets the fault to inject for the new connections.
+func (fl *tlsFaultListener) SetFault(fault TLSHandshakeFault) {
+	fl.mu.Lock()
+	fl.fault = fault
+	fl.mu.Unlock()
+}
+
+// Accept implements [net.Listener].
+func (fl *tlsFaultListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := fl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// register the conn before reading from it, such that Close
+		// tears it down even when the client never sends anything
+		fl.mu.Lock()
+		fault, closed := fl.fault, fl.closed
+		if fault != TLSHandshakeFaultNone && !closed {
+			fl.conns[conn] = struct{}{}
+		}
+		fl.mu.Unlock()
+
+		switch {
+		case fault == TLSHandshakeFaultNone:
+			return conn, nil
+		case closed:
+			conn.Close()
+		default:
+			go fl.serveFault(conn, fault)
+		}
+	}
+}
+
+// serveFault injects the given fault into the given conn, which
+// MUST have been registered into the conns map.
+func (fl *tlsFaultListener) serveFault(conn net.Conn, fault TLSHandshakeFault) {
+	defer func() {
+		fl.mu.Lock()
+		delete(fl.conns, conn)
+		fl.mu.Unlock()
+		conn.Close()
+	}()
+
+	if err := readTLSRecord(conn); err != nil {
+		return
+	}
+
+	switch fault {
+	case TLSHandshakeFaultStall:
+		io.Copy(io.Discard, conn) // until either side closes the conn
+
+	case TLSHandshakeFaultAlert:
+		conn.Write(tlsAlertHandshakeFailure)
+
+	case TLSHandshakeFaultReset:
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+	}
+}
+
+// Close implements [net.Listener].
+//
+// We also close the connections still serving a fault.
+func (fl *tlsFaultListener) Close() error {
+	err := fl.Listener.Close()
+	fl.mu.Lock()
+	fl.closed = true
+	for conn := range fl.conns {
+		conn.Close()
+	}
+	fl.mu.Unlock()
+	return err
+}
+
+// readTLSRecord reads a single TLS record (e.g., the ClientHello) from the given conn.
+func readTLSRecord(conn net.Conn) error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	length := int(header[3])<<8 | int(header[4])
+	_, err := io.ReadFull(conn, make([]byte, length))
+	return err
+}
@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMustNewFaultyCert(t *testing.T) {
+	type testCase struct {
+		name   string
+		fault  TLSCertFault
+		expect func(t *testing.T, err error)
+	}
+
+	testCases := []testCase{
+		{
+			name:  "expired",
+			fault: TLSCertFaultExpired,
+			expect: func(t *testing.T, err error) {
+				var certErr x509.CertificateInvalidError
+				assert.True(t, errors.As(err, &certErr))
+				assert.Equal(t, x509.Expired, certErr.Reason)
+			},
+		},
+
+		{
+			name:  "wrong SAN",
+			fault: TLSCertFaultWrongSAN,
+			expect: func(t *testing.T, err error) {
+				var hostErr x509.HostnameError
+				assert.True(t, errors.As(err, &hostErr))
+			},
+		},
+
+		{
+			name:  "untrusted",
+			fault: TLSCertFaultUntrusted,
+			expect: func(t *testing.T, err error) {
+				var authErr x509.UnknownAuthorityError
+				assert.True(t, errors.As(err, &authErr))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// create the faulty cert
+			pki := pkitest.MustNewPKI("testdata")
+			cert := MustNewFaultyCert(pki, tc.fault, &pkitest.SelfSignedCertConfig{
+				CommonName:   "dns.example.com",
+				DNSNames:     []string{"dns.example.com"},
+				Organization: []string{"Example"},
+			})
+
+			// create server
+			srv := MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, NewHandler(NewHandlerConfig()))
+			defer srv.Close()
+
+			// dial
+			tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+			_, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+			tc.expect(t, err)
+		})
+	}
+
+	t.Run("unknown fault", func(t *testing.T) {
+		pki := pkitest.MustNewPKI("testdata")
+		assert.Panics(t, func() {
+			MustNewFaultyCert(pki, TLSCertFault(0), &pkitest.SelfSignedCertConfig{})
+		})
+	})
+}
+
+func TestTLSServerSetHandshakeFault(t *testing.T) {
+	type testCase struct {
+		name   string
+		fault  TLSHandshakeFault
+		expect func(t *testing.T, err error)
+	}
+
+	testCases := []testCase{
+		{
+			name:  "none",
+			fault: TLSHandshakeFaultNone,
+			expect: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+
+		{
+			name:  "stall",
+			fault: TLSHandshakeFaultStall,
+			expect: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			},
+		},
+
+		{
+			name:  "alert",
+			fault: TLSHandshakeFaultAlert,
+			expect: func(t *testing.T, err error) {
+				assert.ErrorContains(t, err, "handshake failure")
+			},
+		},
+
+		{
+			name:  "reset",
+			fault: TLSHandshakeFaultReset,
+			expect: func(t *testing.T, err error) {
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// create pki
+			pki := pkitest.MustNewPKI("testdata")
+			cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+				CommonName:   "dns.example.com",
+				DNSNames:     []string{"dns.example.com"},
+				Organization: []string{"Example"},
+			})
+
+			// create server
+			srv := MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, NewHandler(NewHandlerConfig()))
+			defer srv.Close()
+			srv.SetHandshakeFault(tc.fault)
+
+			// dial
+			ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+			defer cancel()
+			tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+			dialer := &tls.Dialer{Config: tlsCfg}
+			conn, err := dialer.DialContext(ctx, "tcp", srv.Address())
+			if conn != nil {
+				conn.Close()
+			}
+			tc.expect(t, err)
+		})
+	}
+}
+
+func TestHTTPSServerSetHandshakeFault(t *testing.T) {
+	srv, client := newHTTPSFaultTestServer()
+	defer srv.Close()
+
+	// with a fault the request fails
+	srv.SetHandshakeFault(TLSHandshakeFaultAlert)
+	_, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.ErrorContains(t, err, "handshake failure")
+
+	// without a fault the request succeeds
+	srv.SetHandshakeFault(TLSHandshakeFaultNone)
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+}
+
+func TestTLSFaultListenerCloseStalledConns(t *testing.T) {
+	type testCase struct {
+		name    string
+		payload []byte
+	}
+
+	testCases := []testCase{
+		{"the client does not send anything", nil},
+		{"the client sends a partial record", []byte{0x16, 0x03, 0x01}},
+		{"the client sends a whole record", []byte{0x16, 0x03, 0x01, 0x00, 0x02, 0x01, 0x00}},
+	}
+
+	// servers maps the server type to a function creating
+	// a stalling server and returning its listener and close func
+	servers := map[string]func(cert tls.Certificate) (*tlsFaultListener, func()){
+		"TLS": func(cert tls.Certificate) (*tlsFaultListener, func()) {
+			srv := MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, NewHandler(NewHandlerConfig()))
+			srv.SetHandshakeFault(TLSHandshakeFaultStall)
+			return srv.listener, srv.Close
+		},
+		"HTTPS": func(cert tls.Certificate) (*tlsFaultListener, func()) {
+			srv := MustNewHTTPSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, NewHandler(NewHandlerConfig()))
+			srv.SetHandshakeFault(TLSHandshakeFaultStall)
+			return srv.listener, srv.Close
+		},
+	}
+
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	for kind, newServer := range servers {
+		for _, tc := range testCases {
+			t.Run(kind+"/"+tc.name, func(t *testing.T) {
+				// create server and connect
+				listener, closeServer := newServer(cert)
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				assert.NoError(t, err)
+				defer conn.Close()
+				_, err = conn.Write(tc.payload)
+				assert.NoError(t, err)
+
+				// wait for the connection to be registered and close the server
+				for {
+					listener.mu.Lock()
+					count := len(listener.conns)
+					listener.mu.Unlock()
+					if count > 0 {
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				closeServer()
+
+				// the server should have closed the conn (possibly with
+				// a RST segment when it did not read the whole payload)
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = conn.Read(make([]byte, 1))
+				assert.Error(t, err)
+				assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+			})
+		}
+	}
+}
+
+// tlsFaultTestListener is a [net.Listener] returning the conns
+// written into the channel until the channel is closed.
+type tlsFaultTestListener struct {
+	conns chan net.Conn
+}
+
+// Accept implements [net.Listener].
+func (ln *tlsFaultTestListener) Accept() (net.Conn, error) {
+	conn, ok := <-ln.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+// Close implements [net.Listener].
+func (ln *tlsFaultTestListener) Close() error {
+	return nil
+}
+
+// Addr implements [net.Listener].
+func (ln *tlsFaultTestListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestTLSFaultListenerClosesConnsAcceptedAfterClose(t *testing.T) {
+	// close the listener before accepting the conn
+	ln := &tlsFaultTestListener{conns: make(chan net.Conn, 1)}
+	fl := newTLSFaultListener(ln)
+	fl.SetFault(TLSHandshakeFaultStall)
+	assert.NoError(t, fl.Close())
+	client, server := net.Pipe()
+	defer client.Close()
+	ln.conns <- server
+	close(ln.conns)
+
+	// the listener should close the conn without registering it
+	_, err := fl.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Empty(t, fl.conns)
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// tlsInspector hooks into a [*tls.Config] to write NSS key log lines
+// and records the state of each TLS connection completing the handshake.
+type tlsInspector struct {
+	// active contains the HTTPS connections whose state we recorded.
+	active map[net.Conn]struct{}
+
+	// keyLog is the OPTIONAL writer for the key log.
+	keyLog io.Writer
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// states contains the state of each TLS connection.
+	states []tls.ConnectionState
+}
+
+// tlsInspectorMaxStates is the maximum number of connection states we keep,
+// such that long-running servers do not use an unbounded amount of memory.
+const tlsInspectorMaxStates = 1024
+
+// newTLSInspector creates a [*tlsInspector] and installs it into the given
+// config, which MUST be a clone owned by the server. We honour the key log
+// writer already set by the caller.
+//
+// To record the connection states, use [*tlsInspector.Listener] for DNS
+// servers and [*tlsInspector.ConnState] for HTTP servers.
+func newTLSInspector(config *tls.Config) *tlsInspector {
+	ti := &tlsInspector{
+		active: map[net.Conn]struct{}{},
+		keyLog: config.KeyLogWriter,
+		mu:     sync.Mutex{},
+		states: []tls.ConnectionState{},
+	}
+	config.KeyLogWriter = ti
+	return ti
+}
+
+// record records the state of a connection that completed the handshake.
+func (ti *tlsInspector) record(state tls.ConnectionState) {
+	ti.mu.Lock()
+	ti.states = append(ti.states, state)
+	if len(ti.states) > tlsInspectorMaxStates {
+		ti.states = slices.Delete(ti.states, 0, len(ti.states)-tlsInspectorMaxStates)
+	}
+	ti.mu.Unlock()
+}
+
+// Listener wraps a [net.Listener] returning [*tls.Conn] such that we record
+// the state of each conn once its handshake completes successfully.
+func (ti *tlsInspector) Listener(listener net.Listener) net.Listener {
+	return &tlsInspectorListener{listener, ti}
+}
+
+// tlsInspectorListener is the [net.Listener] returned by [*tlsInspector.Listener].
+type tlsInspectorListener struct {
+	net.Listener
+	ti *tlsInspector
+}
+
+// Accept implements [net.Listener].
+func (ln *tlsInspectorListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsInspectorConn{Conn: conn.(*tls.Conn), once: sync.Once{}, ti: ln.ti}, nil
+}
+
+// tlsInspectorConn is the [net.Conn] returned by [*tlsInspectorListener].
+//
+// It also implements ConnectionState, which [dns.ConnectionStater] uses.
+type tlsInspectorConn struct {
+	*tls.Conn
+	once sync.Once
+	ti   *tlsInspector
+}
+
+// Read implements [net.Conn] completing the handshake before reading.
+func (c *tlsInspectorConn) Read(data []byte) (int, error) {
+	c.once.Do(func() {
+		if c.Conn.Handshake() == nil {
+			c.ti.record(c.Conn.ConnectionState())
+		}
+	})
+	return c.Conn.Read(data)
+}
+
+// ConnState is the [http.Server] ConnState callback recording the state
+// of the TLS connections when they become active, which happens after the
+// handshake completed successfully and the client sent a request.
+func (ti *tlsInspector) ConnState(conn net.Conn, state http.ConnState) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateActive:
+		ti.mu.Lock()
+		_, found := ti.active[conn]
+		ti.active[conn] = struct{}{}
+		ti.mu.Unlock()
+		if !found {
+			ti.record(tlsConn.ConnectionState())
+		}
+
+	case http.StateClosed, http.StateHijacked:
+		ti.mu.Lock()
+		delete(ti.active, conn)
+		ti.mu.Unlock()
+	}
+}
+
+// Write implements [io.Writer] forwarding key log lines to the key log writer.
+func (ti *tlsInspector) Write(data []byte) (int, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.keyLog == nil {
+		return len(data), nil
+	}
+	return ti.keyLog.Write(data)
+}
+
+// SetKeyLogWriter sets the key log writer.
+func (ti *tlsInspector) SetKeyLogWriter(w io.Writer) {
+	ti.mu.Lock()
+	ti.keyLog = w
+	ti.mu.Unlock()
+}
+
+// ConnectionStates returns a copy of the recorded connection states.
+func (ti *tlsInspector) ConnectionStates() []tls.ConnectionState {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return slices.Clone(ti.states)
+}
@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is a [bytes.Buffer] safe for concurrent use.
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+// Write implements [io.Writer].
+func (lb *lockedBuffer) Write(data []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(data)
+}
+
+// String returns the buffer content as a string.
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func TestTLSServerInspection(t *testing.T) {
+	// create config
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("2606:4700::6812:1a78"))
+
+	// create handler
+	handler := NewHandler(config)
+
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create server
+	srv := MustNewTLSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"dot"},
+	}, handler)
+	defer srv.Close()
+	keyLog := &lockedBuffer{}
+	srv.SetKeyLogWriter(keyLog)
+
+	// perform two exchanges using the same session cache
+	tlsCfg := &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		NextProtos:         []string{"dot"},
+		RootCAs:            pki.CertPool(),
+		ServerName:         "dns.example.com",
+	}
+	for range 2 {
+		conn, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+		assert.NoError(t, err)
+		query := &dns.Msg{}
+		query.Question = append(query.Question, dns.Question{
+			Name:   dns.CanonicalName("www.example.com"),
+			Qtype:  dns.TypeAAAA,
+			Qclass: dns.ClassINET,
+		})
+		dconn := &dns.Conn{Conn: conn}
+		err = dconn.WriteMsg(query)
+		assert.NoError(t, err)
+		_, err = dconn.ReadMsg()
+		assert.NoError(t, err)
+		conn.Close()
+	}
+
+	// check the key log
+	assert.Equal(t, 2, strings.Count(keyLog.String(), "CLIENT_TRAFFIC_SECRET_0 "))
+
+	// check the connection states
+	states := srv.ConnectionStates()
+	assert.Len(t, states, 2)
+	for idx, state := range states {
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+		assert.Equal(t, "dot", state.NegotiatedProtocol)
+		assert.Equal(t, "dns.example.com", state.ServerName)
+		assert.Equal(t, idx == 1, state.DidResume)
+		assert.True(t, state.CipherSuite != 0)
+	}
+}
+
+func TestHTTPSServerInspection(t *testing.T) {
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create server using the config to set the key log writer
+	keyLog := &lockedBuffer{}
+	srv := MustNewHTTPSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		KeyLogWriter: keyLog,
+	}, NewHandler(NewHandlerConfig()))
+	defer srv.Close()
+
+	// perform the request
+	tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   tlsCfg,
+		ForceAttemptHTTP2: true,
+	}}
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	io.Copy(io.Discard, httpResp.Body)
+	httpResp.Body.Close()
+
+	// check the key log and the connection states
+	assert.Equal(t, 1, strings.Count(keyLog.String(), "CLIENT_TRAFFIC_SECRET_0 "))
+	states := srv.ConnectionStates()
+	assert.Len(t, states, 1)
+	assert.Equal(t, "h2", states[0].NegotiatedProtocol)
+	assert.Equal(t, "dns.example.com", states[0].ServerName)
+
+	// stop writing the key log
+	srv.SetKeyLogWriter(nil)
+	client.CloseIdleConnections()
+	httpResp, err = client.Do(newHTTPSFaultTestRequest(srv.URL()))
+	assert.NoError(t, err)
+	io.Copy(io.Discard, httpResp.Body)
+	httpResp.Body.Close()
+	assert.Equal(t, 1, strings.Count(keyLog.String(), "CLIENT_TRAFFIC_SECRET_0 "))
+	assert.Len(t, srv.ConnectionStates(), 2)
+}
+
+func TestTLSInspectorChainsVerifyConnection(t *testing.T) {
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create a server rejecting all the connections
+	expected := errors.New("mocked error")
+	srv := MustNewTLSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		VerifyConnection: func(tls.ConnectionState) error {
+			return expected
+		},
+	}, NewHandler(NewHandlerConfig()))
+	defer srv.Close()
+
+	// the handshake should fail
+	tlsCfg := &tls.Config{
+		MaxVersion: tls.VersionTLS12,
+		RootCAs:    pki.CertPool(),
+		ServerName: "dns.example.com",
+	}
+	_, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+	assert.Error(t, err)
+	assert.Len(t, srv.ConnectionStates(), 0)
+}
+
+func TestTLSInspectorKeepsRecentStates(t *testing.T) {
+	ti := newTLSInspector(&tls.Config{})
+	for idx := range tlsInspectorMaxStates + 10 {
+		ti.record(tls.ConnectionState{ServerName: strconv.Itoa(idx)})
+	}
+	states := ti.ConnectionStates()
+	assert.Len(t, states, tlsInspectorMaxStates)
+	assert.Equal(t, "10", states[0].ServerName)
+	assert.Equal(t, strconv.Itoa(tlsInspectorMaxStates+9), states[len(states)-1].ServerName)
+}
+
+func TestTLSInspectorIgnoresHandshakesRejectedByTheClient(t *testing.T) {
+	// create pki
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "dns.example.com",
+		DNSNames:     []string{"dns.example.com"},
+		Organization: []string{"Example"},
+	})
+
+	// create servers
+	tlsSrv := MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, NewHandler(NewHandlerConfig()))
+	defer tlsSrv.Close()
+	httpsSrv := MustNewHTTPSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, NewHandler(NewHandlerConfig()))
+	defer httpsSrv.Close()
+
+	// the handshakes should fail because the client does not trust the
+	// server, which, with TLS 1.3, happens after the server has sent its
+	// Finished message and verified the connection
+	untrusted := &tls.Config{MinVersion: tls.VersionTLS13, ServerName: "dns.example.com"}
+	_, err := tls.Dial("tcp", tlsSrv.Address(), untrusted)
+	assert.Error(t, err)
+	_, err = tls.Dial("tcp", strings.TrimPrefix(httpsSrv.URL(), "https://"), untrusted)
+	assert.Error(t, err)
+
+	// a successful DNS-over-TLS exchange is the only recorded one
+	trusted := &tls.Config{RootCAs: pki.CertPool(), ServerName: "dns.example.com"}
+	conn, err := tls.Dial("tcp", tlsSrv.Address(), trusted)
+	assert.NoError(t, err)
+	defer conn.Close()
+	dconn := &dns.Conn{Conn: conn}
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	assert.NoError(t, dconn.WriteMsg(query))
+	_, err = dconn.ReadMsg()
+	assert.NoError(t, err)
+	assert.Len(t, tlsSrv.ConnectionStates(), 1)
+
+	// a successful DNS-over-HTTPS exchange is the only recorded one
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   trusted,
+		ForceAttemptHTTP2: true,
+	}}
+	httpResp, err := client.Do(newHTTPSFaultTestRequest(httpsSrv.URL()))
+	assert.NoError(t, err)
+	io.Copy(io.Discard, httpResp.Body)
+	httpResp.Body.Close()
+	assert.Len(t, httpsSrv.ConnectionStates(), 1)
+}
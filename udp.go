@@ -35,10 +35,7 @@ func MustNewUDPServer(lc UDPListenConfig, address string, handler dns.Handler) *
 			Handler:    handler,
 		},
 	}
-	go func() {
-		srv.srv.ActivateAndServe() // in background
-		close(srv.done)
-	}()
+	startDNSServer(srv.srv, srv.done)
 	return srv
 }
 
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// VirtualHosts allows [*TLSServer] and [*HTTPSServer] to emulate several
+// providers on a single listener using SNI-based virtual hosting.
+//
+// Each server name maps to its own certificate and [dns.Handler]. The first
+// server name added is the default, used when the client does not send the
+// SNI extension or sends an unknown server name.
+//
+// Use [*VirtualHosts.TLSConfig] with [MustNewTLSServerWithConfig] or
+// [MustNewHTTPSServerWithConfig] and pass the [*VirtualHosts] as the handler.
+//
+// Construct using [NewVirtualHosts].
+type VirtualHosts struct {
+	defaultName string
+	hosts       map[string]*virtualHost
+	mu          sync.Mutex
+}
+
+// virtualHost is a host served by [*VirtualHosts].
+type virtualHost struct {
+	cert    tls.Certificate
+	handler dns.Handler
+}
+
+// NewVirtualHosts constructs a [*VirtualHosts] instance.
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{
+		defaultName: "",
+		hosts:       map[string]*virtualHost{},
+		mu:          sync.Mutex{},
+	}
+}
+
+// Add adds a server name along with its certificate and [dns.Handler].
+//
+// Adding an existing server name replaces its certificate and handler.
+func (vh *VirtualHosts) Add(serverName string, cert tls.Certificate, handler dns.Handler) {
+	serverName = strings.ToLower(serverName)
+	vh.mu.Lock()
+	if vh.defaultName == "" {
+		vh.defaultName = serverName
+	}
+	vh.hosts[serverName] = &virtualHost{cert: cert, handler: handler}
+	vh.mu.Unlock()
+}
+
+// lookup returns the [*virtualHost] for the given server name, falling back
+// to the default host, or nil when there are no hosts.
+func (vh *VirtualHosts) lookup(serverName string) *virtualHost {
+	vh.mu.Lock()
+	defer vh.mu.Unlock()
+	if host, found := vh.hosts[strings.ToLower(serverName)]; found {
+		return host
+	}
+	return vh.hosts[vh.defaultName]
+}
+
+// errNoVirtualHosts indicates that [*VirtualHosts] does not contain any host.
+var errNoVirtualHosts = errors.New("dnstest: no virtual hosts")
+
+// TLSConfig returns a [*tls.Config] selecting the certificate based on the SNI.
+//
+// You MUST call this method after adding the default host, since the returned
+// config uses its certificate when the client does not send the SNI.
+//
+// This method PANICS if there are no hosts.
+func (vh *VirtualHosts) TLSConfig() *tls.Config {
+	host := vh.lookup("")
+	if host == nil {
+		panic(errNoVirtualHosts)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{host.cert},
+		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := vh.lookup(chi.ServerName)
+			if host == nil {
+				return nil, errNoVirtualHosts
+			}
+			return &host.cert, nil
+		},
+	}
+}
+
+// Ensure that [*VirtualHosts] implements [dns.Handler].
+var _ dns.Handler = &VirtualHosts{}
+
+// ServeDNS implements [dns.Handler].
+//
+// We dispatch the query to the handler of the server name sent by the client.
+func (vh *VirtualHosts) ServeDNS(rw dns.ResponseWriter, query *dns.Msg) {
+	var serverName string
+	if stater, ok := rw.(dns.ConnectionStater); ok {
+		if state := stater.ConnectionState(); state != nil {
+			serverName = state.ServerName
+		}
+	}
+	host := vh.lookup(serverName)
+	if host == nil {
+		resp := &dns.Msg{}
+		resp.SetRcode(query, dns.RcodeRefused)
+		rw.WriteMsg(resp)
+		return
+	}
+	host.handler.ServeDNS(rw, query)
+}
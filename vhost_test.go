@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newVirtualHostsTest creates a [*VirtualHosts] with two providers, where
+// dns.a.example is the default, along with the corresponding PKI.
+func newVirtualHostsTest() (*VirtualHosts, *pkitest.PKI) {
+	pki := pkitest.MustNewPKI("testdata")
+	vh := NewVirtualHosts()
+
+	for _, entry := range []struct {
+		serverName string
+		addr       string
+	}{
+		{"dns.a.example", "1.1.1.1"},
+		{"dns.b.example", "2.2.2.2"},
+	} {
+		cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+			CommonName:   entry.serverName,
+			DNSNames:     []string{entry.serverName},
+			Organization: []string{"Example"},
+		})
+		config := NewHandlerConfig()
+		config.AddNetipAddr("www.example.com", netip.MustParseAddr(entry.addr))
+		vh.Add(entry.serverName, cert, NewHandler(config))
+	}
+
+	return vh, pki
+}
+
+func TestVirtualHostsWithTLSServer(t *testing.T) {
+	vh, pki := newVirtualHostsTest()
+	srv := MustNewTLSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", vh.TLSConfig(), vh)
+	defer srv.Close()
+
+	type testCase struct {
+		name         string
+		serverName   string
+		expectCommon string
+		expectAddrs  []string
+	}
+
+	testCases := []testCase{
+		{
+			name:         "first host",
+			serverName:   "dns.a.example",
+			expectCommon: "dns.a.example",
+			expectAddrs:  []string{"1.1.1.1"},
+		},
+
+		{
+			name:         "second host with mixed case",
+			serverName:   "DNS.B.example",
+			expectCommon: "dns.b.example",
+			expectAddrs:  []string{"2.2.2.2"},
+		},
+
+		{
+			name:         "unknown host",
+			serverName:   "dns.c.example",
+			expectCommon: "dns.a.example",
+			expectAddrs:  []string{"1.1.1.1"},
+		},
+
+		{
+			name:         "without SNI",
+			serverName:   "",
+			expectCommon: "dns.a.example",
+			expectAddrs:  []string{"1.1.1.1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// dial without verifying since some cases do not match the certificate
+			tlsCfg := &tls.Config{
+				InsecureSkipVerify: true,
+				RootCAs:            pki.CertPool(),
+				ServerName:         tc.serverName,
+			}
+			conn, err := tls.Dial("tcp", srv.Address(), tlsCfg)
+			assert.NoError(t, err)
+			defer conn.Close()
+			state := conn.ConnectionState()
+			assert.Equal(t, tc.expectCommon, state.PeerCertificates[0].Subject.CommonName)
+
+			// exchange
+			query := &dns.Msg{}
+			query.Question = append(query.Question, dns.Question{
+				Name:   dns.CanonicalName("www.example.com"),
+				Qtype:  dns.TypeA,
+				Qclass: dns.ClassINET,
+			})
+			dconn := &dns.Conn{Conn: conn}
+			err = dconn.WriteMsg(query)
+			assert.NoError(t, err)
+			resp, err := dconn.ReadMsg()
+			assert.NoError(t, err)
+
+			// get results
+			assert.Equal(t, tc.expectAddrs, collectAddrs(resp))
+		})
+	}
+}
+
+func TestVirtualHostsWithHTTPSServer(t *testing.T) {
+	vh, pki := newVirtualHostsTest()
+	srv := MustNewHTTPSServerWithConfig(&net.ListenConfig{}, "127.0.0.1:0", vh.TLSConfig(), vh)
+	defer srv.Close()
+
+	for serverName, expect := range map[string][]string{
+		"dns.a.example": {"1.1.1.1"},
+		"dns.b.example": {"2.2.2.2"},
+	} {
+		t.Run(serverName, func(t *testing.T) {
+			// create HTTP request containing query
+			query := &dns.Msg{}
+			query.Question = append(query.Question, dns.Question{
+				Name:   dns.CanonicalName("www.example.com"),
+				Qtype:  dns.TypeA,
+				Qclass: dns.ClassINET,
+			})
+			rawQuery := runtimex.PanicOnError1(query.Pack())
+			httpReq := runtimex.PanicOnError1(http.NewRequest("POST", srv.URL(), bytes.NewReader(rawQuery)))
+			httpReq.Header.Set("content-type", "application/dns-message")
+
+			// setup HTTPS client
+			tlsCfg := &tls.Config{RootCAs: pki.CertPool(), ServerName: serverName}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+			// get response body
+			httpResp, err := client.Do(httpReq)
+			assert.NoError(t, err)
+			defer httpResp.Body.Close()
+			assert.True(t, httpResp.StatusCode == http.StatusOK)
+			rawResp, err := io.ReadAll(httpResp.Body)
+			assert.NoError(t, err)
+
+			// parse response body
+			resp := &dns.Msg{}
+			err = resp.Unpack(rawResp)
+			assert.NoError(t, err)
+
+			// get results
+			assert.Equal(t, expect, collectAddrs(resp))
+		})
+	}
+}
+
+func TestVirtualHostsEmpty(t *testing.T) {
+	vh := NewVirtualHosts()
+
+	t.Run("TLSConfig", func(t *testing.T) {
+		assert.Panics(t, func() {
+			vh.TLSConfig()
+		})
+	})
+
+	t.Run("ServeDNS", func(t *testing.T) {
+		query := &dns.Msg{}
+		query.Question = append(query.Question, dns.Question{
+			Name:   dns.CanonicalName("www.example.com"),
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		})
+		rw := &httpsResponseWriter{}
+		vh.ServeDNS(rw, query)
+		resp := &dns.Msg{}
+		assert.NoError(t, resp.Unpack(rw.rawResp))
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	})
+}
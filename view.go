@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// handlerView is a view of a [*HandlerConfig] (see [*HandlerConfig.AddClientView]).
+type handlerView struct {
+	// config is the config of the view.
+	config *HandlerConfig
+
+	// listener is the listener local address or empty.
+	listener string
+
+	// prefix is the client prefix, which is only valid when listener is empty.
+	prefix netip.Prefix
+}
+
+// AddClientView configures split-horizon DNS such that the [*Handler] uses the
+// given view (i.e., another [*HandlerConfig]) to answer the queries coming from
+// client addresses within the given prefix (e.g., 127.0.0.1/32 or ::1/128).
+//
+// When several views match, the handler uses the listener views (see
+// [*HandlerConfig.AddListenerView]) first, and then the client view with the
+// most specific prefix. When no view matches, the handler uses this config,
+// which is therefore the default view. Note that [*Handler.PrepareResponse]
+// always uses the default view because it does not know the client address.
+//
+// The view config is used as is, including its header flags, etc., except
+// for its own views, which we ignore. Therefore, views do not nest and a
+// view may also refer back to this config without causing loops.
+func (c *HandlerConfig) AddClientView(prefix netip.Prefix, view *HandlerConfig) {
+	c.mu.Lock()
+	c.views = append(c.views, handlerView{config: view, prefix: prefix.Masked()})
+	c.mu.Unlock()
+}
+
+// AddListenerView is like [*HandlerConfig.AddClientView] but selects the view
+// using the local address of the listener receiving the query (e.g., the
+// [*UDPServer.Address] value), which allows to share a [*Handler] among
+// servers while using a distinct view for each server.
+func (c *HandlerConfig) AddListenerView(address string, view *HandlerConfig) {
+	c.mu.Lock()
+	c.views = append(c.views, handlerView{config: view, listener: address})
+	c.mu.Unlock()
+}
+
+// selectView returns the view to use for the given response writer, which may
+// be nil, or the config itself when no view matches.
+func (c *HandlerConfig) selectView(rw dns.ResponseWriter) *HandlerConfig {
+	if rw == nil {
+		return c
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 1. prefer the listener views
+	if rw.LocalAddr() != nil {
+		local := rw.LocalAddr().String()
+		for _, view := range c.views {
+			if view.listener != "" && view.listener == local {
+				return view.config
+			}
+		}
+	}
+
+	// 2. then use the most specific client view
+	client, found := addrPortFromNetAddr(rw.RemoteAddr())
+	if !found {
+		return c
+	}
+	selected, bits := c, -1
+	for _, view := range c.views {
+		if view.listener == "" && view.prefix.Contains(client.Addr()) && view.prefix.Bits() > bits {
+			selected, bits = view.config, view.prefix.Bits()
+		}
+	}
+	return selected
+}
+
+// addrPortFromNetAddr converts a [net.Addr], which may be nil, to an unmapped [netip.AddrPort].
+func addrPortFromNetAddr(addr net.Addr) (netip.AddrPort, bool) {
+	var (
+		addrport netip.AddrPort
+		err      error
+	)
+	switch addr := addr.(type) {
+	case nil:
+		return netip.AddrPort{}, false
+	case *net.UDPAddr:
+		addrport = addr.AddrPort()
+	case *net.TCPAddr:
+		addrport = addr.AddrPort()
+	default:
+		addrport, err = netip.ParseAddrPort(addr.String())
+	}
+	if err != nil || !addrport.IsValid() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(addrport.Addr().Unmap(), addrport.Port()), true
+}
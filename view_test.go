@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnstest
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newViewTestConfig creates a config resolving www.example.com to the given address.
+func newViewTestConfig(addr string) *HandlerConfig {
+	config := NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr(addr))
+	return config
+}
+
+// exchangeViewTest queries www.example.com using the given server address.
+func exchangeViewTest(t *testing.T, address string) []string {
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := dns.Exchange(query, address)
+	assert.NoError(t, err)
+	return collectAddrs(resp)
+}
+
+func TestHandlerClientViews(t *testing.T) {
+	// create the config with views for IPv4 and IPv6 loopback
+	config := newViewTestConfig("104.20.34.220")
+	config.AddClientView(netip.MustParsePrefix("127.0.0.0/8"), newViewTestConfig("10.0.0.1"))
+	config.AddClientView(netip.MustParsePrefix("127.0.0.1/32"), newViewTestConfig("10.0.0.2"))
+	config.AddClientView(netip.MustParsePrefix("::1/128"), newViewTestConfig("10.0.0.3"))
+	config.AddClientView(netip.MustParsePrefix("192.0.2.0/24"), newViewTestConfig("10.0.0.4"))
+	handler := NewHandler(config.Clone())
+
+	type testCase struct {
+		name        string
+		address     string
+		expectAddrs []string
+	}
+
+	testCases := []testCase{
+		{"IPv4 loopback uses the most specific view", "127.0.0.1:0", []string{"10.0.0.2"}},
+		{"IPv6 loopback uses its own view", "[::1]:0", []string{"10.0.0.3"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := MustNewUDPServer(&net.ListenConfig{}, tc.address, handler)
+			defer srv.Close()
+			assert.Equal(t, tc.expectAddrs, exchangeViewTest(t, srv.Address()))
+		})
+	}
+
+	t.Run("PrepareResponse uses the default view", func(t *testing.T) {
+		query := &dns.Msg{}
+		query.SetQuestion("www.example.com.", dns.TypeA)
+		assert.Equal(t, []string{"104.20.34.220"}, collectAddrs(handler.PrepareResponse(query)))
+	})
+}
+
+func TestHandlerListenerViews(t *testing.T) {
+	// create two servers sharing the same handler
+	config := newViewTestConfig("104.20.34.220")
+	config.AddClientView(netip.MustParsePrefix("127.0.0.1/32"), newViewTestConfig("10.0.0.1"))
+	handler := NewHandler(config)
+	srv1 := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	defer srv1.Close()
+	srv2 := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	defer srv2.Close()
+
+	// the listener view has precedence over the client view
+	config.AddListenerView(srv2.Address(), newViewTestConfig("10.0.0.2"))
+	assert.Equal(t, []string{"10.0.0.1"}, exchangeViewTest(t, srv1.Address()))
+	assert.Equal(t, []string{"10.0.0.2"}, exchangeViewTest(t, srv2.Address()))
+}
+
+func TestHandlerDefaultView(t *testing.T) {
+	config := newViewTestConfig("104.20.34.220")
+	config.AddClientView(netip.MustParsePrefix("192.0.2.0/24"), newViewTestConfig("10.0.0.1"))
+	config.AddListenerView("127.0.0.1:1", newViewTestConfig("10.0.0.2"))
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config))
+	defer srv.Close()
+	assert.Equal(t, []string{"104.20.34.220"}, exchangeViewTest(t, srv.Address()))
+}
+
+func TestHandlerViewsDoNotNest(t *testing.T) {
+	// create two configs referring to each other
+	config := newViewTestConfig("104.20.34.220")
+	view := newViewTestConfig("10.0.0.1")
+	config.AddClientView(netip.MustParsePrefix("127.0.0.1/32"), view)
+	view.AddClientView(netip.MustParsePrefix("127.0.0.1/32"), config)
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config))
+	defer srv.Close()
+
+	// the view answers without using its own views
+	assert.Equal(t, []string{"10.0.0.1"}, exchangeViewTest(t, srv.Address()))
+}
+
+func TestHandlerConfigCloneSharesViews(t *testing.T) {
+	config := newViewTestConfig("104.20.34.220")
+	view := newViewTestConfig("10.0.0.1")
+	config.AddClientView(netip.MustParsePrefix("127.0.0.1/32"), view)
+	srv := MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", NewHandler(config.Clone()))
+	defer srv.Close()
+
+	// modifying the view affects the clone
+	view.Remove("www.example.com")
+	view.AddNetipAddr("www.example.com", netip.MustParseAddr("10.0.0.2"))
+	assert.Equal(t, []string{"10.0.0.2"}, exchangeViewTest(t, srv.Address()))
+}
+
+func TestAddrPortFromNetAddr(t *testing.T) {
+	type testCase struct {
+		name        string
+		addr        net.Addr
+		expectFound bool
+		expect      string
+	}
+
+	testCases := []testCase{
+		{"nil", nil, false, ""},
+		{"UDP mapped", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}, true, "127.0.0.1:53"},
+		{"TCP", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 853}, true, "[::1]:853"},
+		{"other", &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, false, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addrport, found := addrPortFromNetAddr(tc.addr)
+			assert.Equal(t, tc.expectFound, found)
+			if found {
+				assert.Equal(t, tc.expect, addrport.String())
+			}
+		})
+	}
+}